@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// externalImports returns the paths imported by the Go source content
+// that aren't in the standard library, whose first element has no dot.
+func externalImports(content []byte) ([]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "", gorun.GoSource(content), parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+	var imports []string
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		if first := strings.SplitN(path, "/", 2)[0]; strings.Contains(first, ".") {
+			imports = append(imports, path)
+		}
+	}
+	sort.Strings(imports)
+	return imports, nil
+}
+
+// inModule reports whether there's a go.mod in the directory of
+// sourcefile or above, which go build would use.
+func inModule(sourcefile string) bool {
+	dir, err := filepath.Abs(filepath.Dir(sourcefile))
+	if err != nil {
+		return false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// writeAutoModule writes to runCmdDir the go.mod and go.sum go mod tidy
+// makes for sourcefile, whose content is given, if it imports packages
+// from outside the standard library without being in a module.  They're
+// made once for each set of imports, and kept in the cache entry
+// runCmdDir.  It reports whether it wrote them.
+func writeAutoModule(sourcefile string, content []byte, build *BuildSettings, runCmdDir string) (bool, error) {
+	imports, err := externalImports(content)
+	if err != nil || len(imports) == 0 || inModule(sourcefile) {
+		return false, err
+	}
+	h := sha256.Sum256([]byte(strings.Join(imports, "\n")))
+	dir := filepath.Join(runCmdDir, "automod", hex.EncodeToString(h[:8]))
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+		tidied, err := tidyModule(build, sourcefile, content, nil)
+		if err != nil {
+			return false, err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return false, err
+		}
+		// go.mod last, as it tells the files are complete.
+		for _, name := range []string{"go.sum", "go.mod"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), tidied[name], 0600); err != nil {
+				return false, err
+			}
+		}
+	}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		if err := copyFile(filepath.Join(dir, name), filepath.Join(runCmdDir, name), 0600); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
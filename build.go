@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// BuildTo compiles sourcefile with the settings in opts and writes the
+// resulting binary to output instead of running it.  With universal set,
+// a macOS universal binary is made from amd64 and arm64 builds.
+func BuildTo(opts *Options, sourcefile, output string, universal bool) error {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return err
+	}
+	if err := opts.PrepareSource(sourcefile, content, build); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "gorun-build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	tmpDir := tmp + string(filepath.Separator)
+
+	if !universal {
+		bin := filepath.Join(tmp, "bin")
+		if err := Compile(sourcefile, bin, tmpDir, build); err != nil {
+			return &exitError{ExitCompile, err}
+		}
+		return copyFile(bin, output, 0755)
+	}
+
+	lipo, err := exec.LookPath("lipo")
+	if err != nil {
+		return errors.New("universal binaries need lipo, from the Xcode command line tools")
+	}
+	var bins []string
+	for _, arch := range []string{"amd64", "arm64"} {
+		archBuild := *build
+		archBuild.Env = append(append([]string(nil), build.Env...), "GOOS=darwin", "GOARCH="+arch)
+		bin := filepath.Join(tmp, "bin-"+arch)
+		if err := Compile(sourcefile, bin, tmpDir, &archBuild); err != nil {
+			return &exitError{ExitCompile, err}
+		}
+		bins = append(bins, bin)
+	}
+	return Exec("", nil, append([]string{lipo, "-create", "-output", output}, bins...))
+}
+
+// defaultOutput returns the name of the binary built from sourcefile
+// for goos when no output is given: its base name without the .go
+// extension, with .exe for Windows.
+func defaultOutput(sourcefile, goos string) string {
+	suffix := Target{GOOS: goos}.exeSuffix()
+	name := strings.TrimSuffix(filepath.Base(sourcefile), ".go")
+	if name == filepath.Base(sourcefile) && suffix == "" {
+		name += ".bin"
+	}
+	return name + suffix
+}
+
+// copyFile copies the file src to dst, replacing dst atomically.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".gorun-tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
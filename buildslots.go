@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// slotTimeout is how long a build waits for a slot before going ahead
+// anyway, so that builds can't be held up forever by whoever else holds
+// the slots.
+const slotTimeout = 5 * time.Minute
+
+// MaxBuilds returns how many builds may run at once on the machine, as
+// configured with GORUN_MAX_BUILDS, "cpus" meaning as many as there
+// are CPUs, or zero if builds aren't limited, the default.
+func MaxBuilds() (int, error) {
+	value := os.Getenv("GORUN_MAX_BUILDS")
+	switch value {
+	case "":
+		return 0, nil
+	case "cpus":
+		return runtime.NumCPU(), nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid GORUN_MAX_BUILDS: " + value)
+	}
+	return n, nil
+}
+
+// buildSlotsDir returns the directory holding the build slots shared by
+// all the users of the machine.  It must be owned by root or the user,
+// and sticky, so that others can't replace the slots.
+func buildSlotsDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), "gorun-builds")
+	if err := os.Mkdir(dir, 0777); err == nil {
+		// Like the temporary directory, but whatever the umask.
+		if err := os.Chmod(dir, 0777|os.ModeSticky); err != nil {
+			return "", err
+		}
+	} else if !os.IsExist(err) {
+		return "", err
+	}
+	stat, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !stat.IsDir() {
+		return "", errors.New("unsafe build slots, not a directory: " + dir)
+	}
+	// Windows has a temporary directory per user.
+	if runtime.GOOS != "windows" {
+		if owner := sysStat(stat).Uid; owner != 0 && owner != uint32(os.Geteuid()) {
+			return "", errors.New("unsafe build slots, owned by uid " + strconv.Itoa(int(owner)) + ": " + dir)
+		}
+		if stat.Mode()&os.ModeSticky == 0 {
+			return "", errors.New("unsafe build slots, not sticky: " + dir)
+		}
+	}
+	return dir, nil
+}
+
+// acquireBuildSlot waits until fewer than MaxBuilds builds run on the
+// machine, and returns the function to call once the build is done.
+// Slots are files locked by the builds using them, so that they're
+// freed even if gorun gets killed.  If the slots can't be used, or none
+// is freed within slotTimeout, the build goes ahead unthrottled.
+func acquireBuildSlot() (release func(), err error) {
+	max, err := MaxBuilds()
+	if err != nil || max == 0 {
+		return func() {}, err
+	}
+	dir, err := buildSlotsDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gorun: not limiting builds: "+err.Error())
+		return func() {}, nil
+	}
+	var slots []*os.File
+	defer func() {
+		for _, slot := range slots {
+			slot.Close()
+		}
+	}()
+	for i := 0; i < max; i++ {
+		// Read-only is enough for locking, and lets other users lock
+		// the slots created by someone else.
+		path := filepath.Join(dir, "slot."+strconv.Itoa(i))
+		slot, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|safeOpenFlags, 0666)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gorun: not limiting builds: "+err.Error())
+			return func() {}, nil
+		}
+		slots = append(slots, slot)
+		if stat, err := slot.Stat(); err != nil || !stat.Mode().IsRegular() {
+			fmt.Fprintln(os.Stderr, "gorun: not limiting builds: unsafe build slot, not a file: "+path)
+			return func() {}, nil
+		}
+	}
+	deadline := time.Now().Add(slotTimeout)
+	for wait := 10 * time.Millisecond; time.Now().Before(deadline); {
+		for i, slot := range slots {
+			if locked, _ := lockFile(slot, false); locked {
+				slots = append(slots[:i], slots[i+1:]...)
+				return func() { slot.Close() }, nil
+			}
+		}
+		time.Sleep(wait)
+		if wait < 500*time.Millisecond {
+			wait *= 2
+		}
+	}
+	fmt.Fprintln(os.Stderr, "gorun: no build slot freed in "+slotTimeout.String()+", building anyway")
+	return func() {}, nil
+}
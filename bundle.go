@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// VendorBundle builds sourcefile with the settings in opts against an
+// empty module cache, and packs the modules it downloaded into output, a
+// tar archive compressed according to its extension, that runs given it
+// with --deps-bundle build from without the network.
+func VendorBundle(opts *Options, sourcefile, output string) error {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return err
+	}
+	if err := opts.PrepareSource(sourcefile, content, build); err != nil {
+		return err
+	}
+	if len(gorun.Section(content, "go.mod")) == 0 && len(build.GoMod) == 0 {
+		return errors.New(sourcefile + " has no go.mod, so it needs no modules")
+	}
+	tmp, err := ioutil.TempDir("", "gorun-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	modcache := filepath.Join(tmp, "modcache")
+	build.Env = append(build.Env, "GOMODCACHE="+modcache)
+	// Leave the module cache removable.
+	build.Flags = append(build.Flags, "-modcacherw")
+	if err := Compile(sourcefile, filepath.Join(tmp, "bin"), tmp+string(filepath.Separator), build); err != nil {
+		return &exitError{ExitCompile, err}
+	}
+	return writeBundle(filepath.Join(modcache, "cache", "download"), output)
+}
+
+// bundleCompression returns the commands compressing and decompressing
+// bundles called name, nil for those gorun compresses itself or that
+// aren't compressed.
+func bundleCompression(name string) (compress, decompress []string, err error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"):
+		return []string{"zstd", "-q", "-c"}, []string{"zstd", "-q", "-d", "-c"}, nil
+	case strings.HasSuffix(name, ".tar.xz"):
+		return []string{"xz", "-c"}, []string{"xz", "-d", "-c"}, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".tar"):
+		return nil, nil, nil
+	}
+	return nil, nil, errors.New("unknown bundle format: " + name + " (use .tar, .tar.gz, .tgz, .tar.zst or .tar.xz)")
+}
+
+// isGzipped reports whether the bundle called name is gzipped.
+func isGzipped(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// writeBundle packs the module download directory dir, as served by a
+// module proxy, into the bundle output.
+func writeBundle(dir, output string) (err error) {
+	compress, _, err := bundleCompression(output)
+	if err != nil {
+		return err
+	}
+	tmp := output + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	var w io.Writer = f
+	var closers []io.Closer
+	var cmd *exec.Cmd
+	if compress != nil {
+		cmd = exec.Command(compress[0], compress[1:]...)
+		cmd.Stdout = f
+		cmd.Stderr = os.Stderr
+		pipe, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return errors.New("can't compress bundle: " + err.Error())
+		}
+		w = pipe
+		closers = append(closers, pipe)
+	} else if isGzipped(output) {
+		gz := gzip.NewWriter(f)
+		w = gz
+		closers = append(closers, gz)
+	}
+	tw := tar.NewWriter(w)
+	closers = append([]io.Closer{tw}, closers...)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(path, ".lock") {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	for _, closer := range closers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cmd != nil {
+		if werr := cmd.Wait(); err == nil && werr != nil {
+			err = errors.New("can't compress bundle: " + werr.Error())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, output)
+}
+
+// DepsBundleEnv returns the environment making go build fetch modules
+// from the bundle made by VendorBundle, which is unpacked into the cache
+// the first time it's used.
+func DepsBundleEnv(bundle string) ([]string, error) {
+	sum, err := FileHash(bundle)
+	if err != nil {
+		return nil, errors.New("can't read deps bundle: " + err.Error())
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(auxDir(runBaseDir, "bundles"), sum[:16])
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := unpackBundle(bundle, dir); err != nil {
+			return nil, errors.New("can't unpack deps bundle: " + err.Error())
+		}
+	}
+	return []string{
+		"GOPROXY=file://" + filepath.ToSlash(dir),
+		// The checksums are in the go.sum of the script, if anywhere.
+		"GOSUMDB=off",
+		"GOTOOLCHAIN=local",
+	}, nil
+}
+
+// unpackBundle extracts bundle into dir.
+func unpackBundle(bundle, dir string) error {
+	_, decompress, err := bundleCompression(bundle)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(bundle)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if decompress != nil {
+		cmd := exec.Command(decompress[0], decompress[1:]...)
+		cmd.Stdin = f
+		cmd.Stderr = os.Stderr
+		pipe, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		defer cmd.Wait()
+		r = pipe
+	} else if isGzipped(bundle) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "unpack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(header.Name)
+		if header.Typeflag != tar.TypeReg || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return errors.New("unexpected entry in bundle: " + header.Name)
+		}
+		path := filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dir)
+}
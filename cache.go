@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheEntry describes one cached script directory under runBaseDir.
+type cacheEntry struct {
+	name   string
+	size   int64
+	access time.Time
+}
+
+// CacheMaxSize returns the cache size limit in bytes configured with
+// GORUN_CACHE_MAX_SIZE, or zero if the cache size is unlimited.
+func CacheMaxSize() (int64, error) {
+	value := os.Getenv("GORUN_CACHE_MAX_SIZE")
+	if value == "" {
+		return 0, nil
+	}
+	size, err := parseSize(value)
+	if err != nil {
+		return 0, errors.New("invalid GORUN_CACHE_MAX_SIZE: " + value)
+	}
+	return size, nil
+}
+
+// parseSize parses a byte count such as "1048576", "512K", "100MB",
+// "2G" or "1.5G".  Suffixes are powers of 1024.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "IB")
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:n-1]
+		}
+	}
+	if strings.Contains(s, ".") {
+		f, err := strconv.ParseFloat(s, 64)
+		// Not every int64 is a float64, hence >=.
+		if err != nil || strings.Trim(s, "0123456789.") != "" || f*float64(mult) >= math.MaxInt64 {
+			return 0, errors.New("invalid size: " + s)
+		}
+		return int64(f * float64(mult)), nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return 0, errors.New("invalid size: " + s)
+	}
+	return n * mult, nil
+}
+
+// dirSize returns the total size of the regular files under dir.
+// Files disappearing during the walk are ignored.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// auxDirName is the directory under runBaseDir holding what isn't the
+// cache entry of a script: the sources of piped, compressed, remote and
+// Markdown scripts, the binaries shared by identical scripts, fetched
+// go.mod files and unpacked bundles.  Entries are named after absolute
+// paths, so none can have this name.
+const auxDirName = "_aux"
+
+// auxDir returns the auxiliary directory kind under runBaseDir.
+func auxDir(runBaseDir, kind string) string {
+	return filepath.Join(runBaseDir, auxDirName, kind)
+}
+
+// materialize writes content as the file name in dir, creating dir if
+// needed, and returns its path.  The file is only written when its
+// contents change, as a newer file means rebuilding the script, and
+// replaced at once for concurrent runs to never read part of it.
+func materialize(dir, name string, content []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		return path, nil
+	}
+	tmp, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+// cacheEntries returns the script directories under runBaseDir,
+// least recently run first.
+func cacheEntries(runBaseDir string) ([]cacheEntry, error) {
+	infos, err := ioutil.ReadDir(runBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, info := range infos {
+		if !info.IsDir() || info.Name() == auxDirName {
+			continue
+		}
+		atim := atime(info)
+		entries = append(entries, cacheEntry{
+			name:   info.Name(),
+			size:   dirSize(filepath.Join(runBaseDir, info.Name())),
+			access: time.Unix(int64(atim.Sec), int64(atim.Nsec)),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].access.Before(entries[j].access)
+	})
+	return entries, nil
+}
+
+// auxEntries returns the files and directories of the auxiliary
+// directories under runBaseDir, named relative to it, with the last time
+// any of their files was accessed.
+func auxEntries(runBaseDir string) []cacheEntry {
+	var entries []cacheEntry
+	kinds, _ := ioutil.ReadDir(filepath.Join(runBaseDir, auxDirName))
+	for _, kind := range kinds {
+		infos, _ := ioutil.ReadDir(auxDir(runBaseDir, kind.Name()))
+		for _, info := range infos {
+			name := filepath.Join(auxDirName, kind.Name(), info.Name())
+			entry := cacheEntry{name: name}
+			filepath.Walk(filepath.Join(runBaseDir, name), func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				if info.Mode().IsRegular() {
+					entry.size += info.Size()
+				}
+				atim := atime(info)
+				if access := time.Unix(int64(atim.Sec), int64(atim.Nsec)); access.After(entry.access) {
+					entry.access = access
+				}
+				return nil
+			})
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// lockEntry opens and locks the build lock of the cache entry dir,
+// waiting for it if wait is set.  It returns nil if the entry is gone,
+// or is locked and wait isn't set.  Entries are removed with their lock
+// held, so a lock found removed once taken is taken again.
+func lockEntry(dir string, wait bool) (*os.File, error) {
+	for {
+		if wait {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return nil, err
+			}
+		}
+		path := filepath.Join(dir, "build.lock")
+		lock, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if os.IsNotExist(err) && !wait {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if locked, err := lockFile(lock, wait); !locked {
+			lock.Close()
+			return nil, err
+		}
+		lstat, err := lock.Stat()
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		if pstat, err := os.Stat(path); err == nil && os.SameFile(lstat, pstat) {
+			return lock, nil
+		}
+		lock.Close()
+		if !wait {
+			return nil, nil
+		}
+	}
+}
+
+// removeEntry removes the cache entry dir, unless a build in it holds
+// its lock.  It reports whether the entry is gone.
+func removeEntry(dir string) (bool, error) {
+	lock, err := lockEntry(dir, false)
+	if lock == nil {
+		_, statErr := os.Stat(dir)
+		return os.IsNotExist(statErr), err
+	}
+	defer lock.Close()
+	if err := os.RemoveAll(dir); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// EvictToSize removes the least recently run entries under runBaseDir
+// until the cache takes at most maxSize bytes, regardless of their age.
+// The entry named keep, usually the one about to be run, is never
+// removed, nor are those being built into.
+func EvictToSize(runBaseDir string, maxSize int64, keep string) error {
+	entries, err := cacheEntries(runBaseDir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+	for _, entry := range entries {
+		if total <= maxSize {
+			break
+		}
+		if entry.name == keep {
+			continue
+		}
+		if removed, _ := removeEntry(filepath.Join(runBaseDir, entry.name)); removed {
+			total -= entry.size
+		}
+	}
+	return nil
+}
+
+// formatSize formats a byte count for humans.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(size)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
+
+// RemoveEntries removes the cache entries under runBaseDir of the
+// scripts sourcefiles, with all the binaries built from them.  The
+// removed entries are returned, and apart from them those a build holds
+// the lock of, which are left in place as GC leaves them; with dryRun
+// set nothing is actually removed.  Scripts that aren't cached are
+// skipped.
+func RemoveEntries(runBaseDir string, sourcefiles []string, dryRun bool) (removed, busy []cacheEntry, err error) {
+	for _, sourcefile := range sourcefiles {
+		name, _, err := cacheEntryName(sourcefile)
+		if err != nil {
+			return removed, busy, err
+		}
+		dir := filepath.Join(runBaseDir, name)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		entry := cacheEntry{name: name, size: dirSize(dir)}
+		if !dryRun {
+			gone, err := removeEntry(dir)
+			if err != nil {
+				return removed, busy, err
+			}
+			if !gone {
+				busy = append(busy, entry)
+				continue
+			}
+		}
+		removed = append(removed, entry)
+	}
+	return removed, busy, nil
+}
+
+// GC applies the cache cleaning policy to runBaseDir right away,
+// ignoring the last-cleaned marker.  Entries not run since cleanLine
+// and legacy entries are removed and, if maxSize is positive, so are
+// the least recently run entries until the cache fits in maxSize bytes.
+// Auxiliary files not used since cleanLine are removed too.  The
+// affected entries are returned; with dryRun set nothing is actually
+// removed.
+func GC(runBaseDir string, cleanLine time.Time, maxSize int64, dryRun bool) ([]cacheEntry, error) {
+	entries, err := cacheEntries(runBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+	var removed []cacheEntry
+	for _, entry := range entries {
+		if !entry.access.Before(cleanLine) && (maxSize <= 0 || total <= maxSize) && !isLegacyEntry(entry.name) {
+			continue
+		}
+		if !dryRun {
+			gone, err := removeEntry(filepath.Join(runBaseDir, entry.name))
+			if err != nil {
+				return removed, err
+			}
+			if !gone {
+				// Being built into.
+				continue
+			}
+		}
+		total -= entry.size
+		removed = append(removed, entry)
+	}
+	for _, entry := range auxEntries(runBaseDir) {
+		if !entry.access.Before(cleanLine) {
+			continue
+		}
+		if !dryRun {
+			if err := os.RemoveAll(filepath.Join(runBaseDir, entry.name)); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		size int64
+		ok   bool
+	}{
+		{"1048576", 1048576, true},
+		{"512K", 512 << 10, true},
+		{"100MB", 100 << 20, true},
+		{"2g", 2 << 30, true},
+		{" 3GiB ", 3 << 30, true},
+		{"1T", 1 << 40, true},
+		{"1.5G", 3 << 29, true},
+		{".5K", 512, true},
+		{strconv.FormatInt(math.MaxInt64, 10), math.MaxInt64, true},
+		{"9223372036854775808", 0, false},
+		{"8388608T", 0, false},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608.0T", 0, false},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"-1.5G", 0, false},
+		{"1.5e3", 0, false},
+		{"NaN", 0, false},
+		{"1..5G", 0, false},
+		{"G", 0, false},
+	}
+	for _, test := range tests {
+		size, err := parseSize(test.s)
+		if (err == nil) != test.ok || size != test.size {
+			t.Errorf("parseSize(%q) = %d, %v", test.s, size, err)
+		}
+	}
+}
+
+func TestRemoveEntryLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorun-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	entry := filepath.Join(dir, "entry")
+	lock, err := lockEntry(entry, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gone, err := removeEntry(entry); gone || err != nil {
+		t.Errorf("removed an entry being built into: %v, %v", gone, err)
+	}
+	lock.Close()
+	if gone, err := removeEntry(entry); !gone || err != nil {
+		t.Errorf("didn't remove an unlocked entry: %v, %v", gone, err)
+	}
+	if gone, err := removeEntry(entry); !gone || err != nil {
+		t.Errorf("removing a removed entry: %v, %v", gone, err)
+	}
+}
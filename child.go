@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// forwardedSignals are relayed by gorun to the script in child mode.
+var forwardedSignals = append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}, userSignals...)
+
+// RunChild runs runFile as a child process with arguments args, args[0]
+// being what the script sees as its name, instead of replacing gorun
+// with it.  Signals received by gorun are forwarded to the script.  If
+// opts.LogDriver isn't empty, the script output and its lifecycle events
+// are sent to the given logging backend instead of stdout and stderr,
+// and if opts.Rusage isn't empty, or in CI mode, the resources used by
+// the script are reported once it's done.
+//
+// The exit status of the script is returned, 128+N if it was killed by
+// signal N.  An error is only returned
+// if the script couldn't be started.
+func RunChild(runFile string, args []string, opts *Options) (int, error) {
+	cmd := exec.Command(runFile, args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	var logger Logger
+	var stdout, stderr io.Reader
+	if opts.LogDriver != "" {
+		var err error
+		logger, err = NewLogger(opts.LogDriver, filepath.Base(args[0]))
+		if err != nil {
+			return 0, err
+		}
+		defer logger.Close()
+		cmd.Stdout, cmd.Stderr = nil, nil
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return 0, err
+		}
+		if stderr, err = cmd.StderrPipe(); err != nil {
+			return 0, err
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	trackRun(cmd.Process.Pid, runFile, args, opts)
+	defer untrackRun(cmd.Process.Pid)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	var output sync.WaitGroup
+	if logger != nil {
+		logger.Log(PriorityNotice, "started "+args[0]+" with pid "+strconv.Itoa(cmd.Process.Pid))
+		output.Add(2)
+		go logLines(&output, logger, PriorityInfo, stdout)
+		go logLines(&output, logger, PriorityErr, stderr)
+	}
+	output.Wait()
+
+	err := cmd.Wait()
+	wall := time.Since(start)
+	status := 0
+	outcome := "exited with status 0"
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return 0, err
+		}
+		ws := exitErr.Sys().(syscall.WaitStatus)
+		status = ws.ExitStatus()
+		outcome = "exited with status " + strconv.Itoa(status)
+		if ws.Signaled() {
+			// Like shells do, so crashes can be told apart.
+			status = 128 + int(ws.Signal())
+			outcome = "terminated by " + signalName(ws.Signal())
+			if ws.CoreDump() {
+				outcome += " (core dumped)"
+			}
+			if opts.ReportSignal {
+				fmt.Fprintln(os.Stderr, "gorun: "+args[0]+" "+outcome)
+			}
+		} else if status < 0 {
+			status = ExitFailure
+		}
+	}
+	if logger != nil {
+		logger.Log(PriorityNotice, args[0]+" "+outcome)
+	}
+	format := opts.Rusage
+	if format == "" && opts.CI {
+		format = "json"
+	}
+	if format != "" {
+		usage := newUsage(cmd.ProcessState, wall, status)
+		if err := usage.Report(os.Stderr, format); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// signalNames are the names of the signals commonly killing scripts.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+// signalName returns the name of sig, such as SIGTERM.
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
+
+// Usage describes the resources used by a script run in child mode.
+type Usage struct {
+	ExitStatus  int     `json:"exit_status"`
+	WallSeconds float64 `json:"wall_seconds"`
+	UserSeconds float64 `json:"user_seconds"`
+	SysSeconds  float64 `json:"sys_seconds"`
+	MaxRSS      int64   `json:"max_rss_bytes"`
+	MinorFaults int64   `json:"minor_faults"`
+	MajorFaults int64   `json:"major_faults"`
+}
+
+func newUsage(state *os.ProcessState, wall time.Duration, status int) *Usage {
+	usage := &Usage{
+		ExitStatus:  status,
+		WallSeconds: wall.Seconds(),
+		UserSeconds: state.UserTime().Seconds(),
+		SysSeconds:  state.SystemTime().Seconds(),
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSS = maxRSS(ru)
+		usage.MinorFaults, usage.MajorFaults = pageFaults(ru)
+	}
+	return usage
+}
+
+// Report writes usage to w, formatted as text or json.
+func (usage *Usage) Report(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		_, err := fmt.Fprintf(w, "gorun: wall %.3fs, user %.3fs, sys %.3fs, max rss %s, page faults %d minor %d major\n",
+			usage.WallSeconds, usage.UserSeconds, usage.SysSeconds, formatSize(usage.MaxRSS), usage.MinorFaults, usage.MajorFaults)
+		return err
+	case "json":
+		return json.NewEncoder(w).Encode(usage)
+	}
+	return errors.New("unknown resource usage format: " + format)
+}
+
+// logLines sends each line read from r to logger with the given priority.
+func logLines(wg *sync.WaitGroup, logger Logger, priority int, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		logger.Log(priority, scanner.Text())
+	}
+	// Keep draining so the script doesn't block after a very long line.
+	io.Copy(ioutil.Discard, r)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// ciBuildEnv returns the environment making the C compilers run by cgo
+// treat warnings as errors, keeping the flags they'd use otherwise.
+func ciBuildEnv() []string {
+	cflags := os.Getenv("CGO_CFLAGS")
+	if cflags == "" {
+		cflags = "-O2 -g"
+	}
+	cxxflags := os.Getenv("CGO_CXXFLAGS")
+	if cxxflags == "" {
+		cxxflags = "-O2 -g"
+	}
+	return []string{"CGO_CFLAGS=" + cflags + " -Werror", "CGO_CXXFLAGS=" + cxxflags + " -Werror"}
+}
+
+// vetFlags returns the flags among the go build flags that go vet needs
+// to check the same package as built.
+func vetFlags(flags []string) []string {
+	var vet []string
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "-mod=") || strings.HasPrefix(flag, "-tags=") || strings.HasPrefix(flag, "-overlay=") {
+			vet = append(vet, flag)
+		}
+	}
+	return vet
+}
+
+// Vet runs go vet in dir with env on sources, built with flags, its
+// findings going to diagnostics.
+func Vet(gotool, dir string, env, flags, sources []string, diagnostics io.Writer) error {
+	args := append([]string{gotool, "vet"}, vetFlags(flags)...)
+	if err := ExecTo(dir, env, append(args, sources...), os.Stdout, diagnostics); err != nil {
+		return errors.New("go vet reported problems: " + err.Error())
+	}
+	return nil
+}
+
+// ciResult is the outcome reported on stderr in CI mode when gorun
+// failed before the script ran.
+type ciResult struct {
+	ExitStatus int    `json:"exit_status"`
+	Error      string `json:"error"`
+}
+
+// ReportCI writes err, returned by running a script in CI mode, to w as
+// a JSON object.  Scripts that ran already reported their resource usage,
+// so nothing is written for them.
+func ReportCI(w io.Writer, err error) error {
+	if e, ok := err.(*exitError); err == nil || ok && e.err == nil {
+		return nil
+	}
+	return json.NewEncoder(w).Encode(ciResult{ExitStatus: exitCode(err), Error: err.Error()})
+}
@@ -0,0 +1,1016 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Command is a gorun subcommand.
+type Command struct {
+	// Run runs the command with the arguments following its name.
+	Run func(opts *Options, args []string) error
+	// Args is the synopsis of the arguments of the command.
+	Args string
+	// Summary says what the command does.
+	Summary string
+}
+
+// commands maps the gorun subcommand names to their implementations.
+// Anything else on the command line, or a file named like a command, is
+// taken to be a script to run, as with the run command (see
+// lookupCommand).
+var commands map[string]*Command
+
+func init() {
+	commands = map[string]*Command{
+		"build":         {buildCommand, "[-o output] [--universal|--system|--shared] <source file>", "compile a script into a binary"},
+		"cache":         {cacheCommand, "rm <source file> [...] | stats [--per-script]", "manage the cache entries of scripts"},
+		"clean":         {cleanCommand, "<source file> [...] | --all | --older-than=duration [--dry-run]", "remove cached binaries, of scripts, all of them or old ones"},
+		"completion":    {completionCommand, "--script <source file> [--shell=bash|zsh|fish] [--name=command]", "print shell completion for the arguments of a script"},
+		"cron":          {cronCommand, "install [--flags=flags] <source file> [...] | list | remove <source file> [...]", "run scripts on the schedules of their cron section"},
+		"diff":          {diffCommand, "<source file> [...]", "show how the go.mod and go.sum of scripts differ from go mod tidy"},
+		"env":           {envCommand, "[--json] [source file] | create <name> | activate <name> | deactivate", "print the settings gorun resolves, or manage environments"},
+		"fmt":           {fmtCommand, "[-l] <source file> [...]", "format scripts, keeping their bang line and sections"},
+		"freeze":        {freezeCommand, "<source file> [...]", "pin the dependencies of scripts in go.mod and go.sum sections"},
+		"gc":            {gcCommand, "[--older-than=duration] [--dry-run] | --auto", "clean the cache now"},
+		"go-run":        {goRunCommand, "[build flags] [-exec xprog] <source file|package> [...]", "run a script as go run would, caching its binary"},
+		"get":           {getCommand, "<source file> <module[@version]> [...]", "add requirements to the go.mod section of a script, with all their checksums"},
+		"help":          {helpCommand, "[command]", "show the usage of gorun or of a command"},
+		"hook":          {hookCommand, "install [--force] <hook name> <source file>", "run a script as a git hook"},
+		"info":          {infoCommand, "[--json] <source file>", "show what gorun makes of a script"},
+		"list":          {listCommand, "", "list the scripts catalogued for the current directory"},
+		"lsp":           {lspCommand, "<source file>", "run gopls for a script"},
+		"md":            {mdCommand, "<markdown file> [block name] [-- ...]", "run the Go code blocks of a Markdown document"},
+		"pack-multi":    {packMultiCommand, "-o output <source file> [...]", "build scripts into a single multi-call binary"},
+		"pick":          {pickCommand, "[dir] [...]", "choose a script of a directory with a fuzzy finder, and run it"},
+		"ps":            {psCommand, "[--json]", "list the scripts launched by gorun that are running"},
+		"release":       {releaseCommand, "--targets=goos/goarch,... [-d dir] [--gzip] <source file>", "build a script for several platforms into a release directory"},
+		"replay":        {replayCommand, "<recording name|dir>", "run a script again as recorded with --record"},
+		"repl":          {replCommand, "[--mod <source file>]", "start an interactive Go session, which runs earlier statements again on each input"},
+		"restart":       {restartCommand, "[--grace=duration] <source file|script name>", "stop the running instances of a script and start them again"},
+		"run":           {runCommand, "<source file|URL|script name|-> [...]", "run a script file or URL, one read from stdin with -, or a script catalogued by name (the default)"},
+		"serve-wasm":    {serveWasmCommand, "[--addr=host:port] <source file>", "run a script in the browser, built for WebAssembly"},
+		"stop":          {stopCommand, "[--grace=duration] <source file|script name>", "stop the running instances of a script"},
+		"up":            {upCommand, "[--grace=duration] [--procfile=file] [<source file> ...]", "run scripts together, with their output prefixed by their name"},
+		"verify":        {verifyCommand, "--targets=goos/goarch,... <source file>", "check that a script builds for other platforms"},
+		"vendor-bundle": {vendorBundleCommand, "-o bundle <source file>", "pack the modules needed by a script for offline builds with --deps-bundle"},
+		"version":       {versionCommand, "", "print the version of gorun and of the go tool it builds with"},
+		"warm":          {warmCommand, "[-j jobs] <source file> [...]", "download the modules needed by scripts without building them"},
+	}
+}
+
+// lookupCommand returns the command called name, unless a file by that
+// name exists, so that scripts named like commands keep running.
+func lookupCommand(name string) (*Command, bool) {
+	if stat, err := os.Stat(name); err == nil && stat.Mode().IsRegular() {
+		return nil, false
+	}
+	command, ok := commands[name]
+	return command, ok
+}
+
+// usageError returns the error reporting the wrong use of the command
+// called name.
+func usageError(name string) error {
+	return errors.New("usage: gorun " + strings.TrimSpace(name+" "+commands[name].Args))
+}
+
+// goRunCommand implements "gorun go-run", which takes the place of go
+// run, with its flags.
+func goRunCommand(opts *Options, args []string) error {
+	if len(args) == 0 {
+		return usageError("go-run")
+	}
+	err := GoRun(opts, args)
+	if err == nil {
+		err = errors.New("an uncaught error has occurred")
+	}
+	return err
+}
+
+// helpCommand implements "gorun help", which shows the usage of gorun,
+// or of the given command.
+func helpCommand(opts *Options, args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		return errors.New("unknown command: " + args[0])
+	}
+	fmt.Println("usage: gorun " + strings.TrimSpace(args[0]+" "+command.Args))
+	fmt.Println()
+	fmt.Println(strings.ToUpper(command.Summary[:1]) + command.Summary[1:] + ".")
+	return nil
+}
+
+// versionCommand implements "gorun version", which prints the version
+// of gorun and how it was built, and the go tool compiling scripts.
+func versionCommand(opts *Options, args []string) error {
+	if len(args) != 0 {
+		return usageError("version")
+	}
+	return PrintVersion(os.Stdout)
+}
+
+// gcCommand implements "gorun gc", which cleans the cache on demand.
+func gcCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", CleanFileDelay, "remove entries not run for this long")
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	auto := flags.Bool("auto", false, "clean as running scripts does, if due and no other cleaning is running")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	if *auto {
+		return CleanDir(runBaseDir, time.Now())
+	}
+	maxSize, err := CacheMaxSize()
+	if err != nil {
+		return err
+	}
+	removed, err := GC(runBaseDir, time.Now().Add(-*olderThan), maxSize, *dryRun)
+	reportRemoved(runBaseDir, removed, *dryRun)
+	return err
+}
+
+// cleanCommand implements "gorun clean", which purges the cache entries
+// of the given scripts, those not run for a given time, or all of them.
+func cleanCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("clean", flag.ContinueOnError)
+	all := flags.Bool("all", false, "remove every entry of the cache")
+	olderThan := flags.Duration("older-than", 0, "remove the entries not run for this long")
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	var removed, busy []cacheEntry
+	switch {
+	case *all && *olderThan == 0 && flags.NArg() == 0:
+		removed, err = GC(runBaseDir, time.Now(), 0, *dryRun)
+	case *olderThan > 0 && !*all && flags.NArg() == 0:
+		removed, err = GC(runBaseDir, time.Now().Add(-*olderThan), 0, *dryRun)
+	case flags.NArg() > 0 && !*all && *olderThan == 0:
+		removed, busy, err = RemoveEntries(runBaseDir, flags.Args(), *dryRun)
+	default:
+		return usageError("clean")
+	}
+	for _, entry := range busy {
+		fmt.Printf("left %s, a build is using it\n", filepath.Join(runBaseDir, entry.name))
+	}
+	reportRemoved(runBaseDir, removed, *dryRun)
+	return err
+}
+
+// reportRemoved prints the cache entries removed from runBaseDir, or
+// that would be with dryRun set, and the space they took.
+func reportRemoved(runBaseDir string, removed []cacheEntry, dryRun bool) {
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	var total int64
+	for _, entry := range removed {
+		fmt.Printf("%s %s (%s)\n", verb, filepath.Join(runBaseDir, entry.name), formatSize(entry.size))
+		total += entry.size
+	}
+	fmt.Printf("%s %d entries, %s\n", verb, len(removed), formatSize(total))
+}
+
+// infoCommand implements "gorun info", which shows what gorun makes of
+// a script and the state of its binary in the cache.
+func infoCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the information as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError("info")
+	}
+	info, err := Inspect(opts, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return info.Print(os.Stdout, *asJSON)
+}
+
+// psCommand implements "gorun ps", which lists the scripts launched by
+// gorun that are still running.
+func psCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("ps", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the scripts as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return usageError("ps")
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	records, err := RunningScripts(runBaseDir)
+	if err != nil {
+		return err
+	}
+	return PrintRunning(os.Stdout, records, *asJSON)
+}
+
+// listCommand implements "gorun list", which shows the scripts
+// catalogued in the manifest for the current directory.
+func listCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	path, err := FindManifest(".")
+	if err != nil {
+		return err
+	}
+	scripts, err := ReadManifest(path)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, script := range scripts {
+		entry, err := filepath.Rel(filepath.Dir(path), script.Entry)
+		if err != nil {
+			entry = script.Entry
+		}
+		goVersion := ""
+		if script.Go != "" {
+			goVersion = "go" + script.Go
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", script.Name, script.Description, entry, goVersion)
+	}
+	return w.Flush()
+}
+
+// runCommand implements "gorun run", which runs a script file, or a
+// script catalogued in the manifest by its name.
+func runCommand(opts *Options, args []string) error {
+	if len(args) == 0 {
+		return usageError("run")
+	}
+	sourcefile := resolveScript(args[0])
+	args = append([]string{sourcefile}, args[1:]...)
+	var err error
+	if IsRemote(sourcefile) {
+		err = RunRemote(opts, args)
+	} else if IsMarkdown(sourcefile) {
+		err = RunMarkdown(opts, "", args)
+	} else if sourcefile == "-" || IsPiped(sourcefile) {
+		err = RunPiped(opts, args)
+	} else if IsEncrypted(sourcefile) {
+		err = RunEncrypted(opts, args)
+	} else if IsCompressed(sourcefile) {
+		err = RunCompressed(opts, args)
+	} else if stat, serr := os.Stat(sourcefile); serr == nil && stat.IsDir() && isTerminal(os.Stdin) {
+		err = RunPicked(opts, sourcefile, args[1:])
+	} else {
+		err = Run(opts, args)
+	}
+	if err == nil {
+		err = errors.New("an uncaught error has occurred")
+	}
+	return err
+}
+
+// resolveScript returns the source file of the script called name: the
+// file itself if it exists, or else the script catalogued by that name.
+func resolveScript(name string) string {
+	if _, err := os.Stat(name); os.IsNotExist(err) && name != "-" && !strings.ContainsRune(name, filepath.Separator) {
+		if script, err := ManifestLookup(name); err == nil {
+			return script.Entry
+		}
+	}
+	return name
+}
+
+// pickCommand implements "gorun pick", which lets the user choose one
+// of the scripts of a directory, the current one by default, and runs it.
+func pickCommand(opts *Options, args []string) error {
+	dir := "."
+	if len(args) > 0 {
+		dir, args = args[0], args[1:]
+	}
+	err := RunPicked(opts, dir, args)
+	if err == nil {
+		err = errors.New("an uncaught error has occurred")
+	}
+	return err
+}
+
+// stopCommand implements "gorun stop", which stops the running instances
+// of a script.
+func stopCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("stop", flag.ContinueOnError)
+	grace := flags.Duration("grace", 10*time.Second, "time to wait after SIGTERM before sending SIGKILL")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError("stop")
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	records, err := RunningInstances(runBaseDir, resolveScript(flags.Arg(0)))
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("no running instance of " + flags.Arg(0))
+	}
+	return StopInstances(records, *grace)
+}
+
+// replayCommand implements "gorun replay", which runs a script again
+// with the inputs recorded by --record.
+func replayCommand(opts *Options, args []string) error {
+	if len(args) != 1 {
+		return usageError("replay")
+	}
+	err := Replay(args[0])
+	if err == nil {
+		err = errors.New("an uncaught error has occurred")
+	}
+	return err
+}
+
+// restartCommand implements "gorun restart", which stops the running
+// instances of a script and starts them again the same way.  Daemons are
+// restarted in the background; an instance that ran in the foreground
+// is restarted in the foreground of gorun restart.
+func restartCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("restart", flag.ContinueOnError)
+	grace := flags.Duration("grace", 10*time.Second, "time to wait after SIGTERM before sending SIGKILL")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError("restart")
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	records, err := RunningInstances(runBaseDir, resolveScript(flags.Arg(0)))
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("no running instance of " + flags.Arg(0))
+	}
+	var daemons []*RunRecord
+	var foreground *RunRecord
+	for _, record := range records {
+		if record.Options != nil && record.Options.Daemon {
+			daemons = append(daemons, record)
+		} else if foreground != nil {
+			return errors.New("can't restart several instances of " + flags.Arg(0) + " in the foreground")
+		} else {
+			foreground = record
+		}
+	}
+	if err := StopInstances(records, *grace); err != nil {
+		return err
+	}
+	for _, record := range daemons {
+		// A daemon that started is reported as a zero exit status.
+		if err, ok := record.Restart().(*exitError); !ok || err.code != 0 || err.err != nil {
+			return err
+		}
+	}
+	if foreground != nil {
+		return foreground.Restart()
+	}
+	return &exitError{0, nil}
+}
+
+// upCommand implements "gorun up", which runs the scripts given, or
+// those listed in a Procfile, together until one of them exits.
+func upCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("up", flag.ContinueOnError)
+	grace := flags.Duration("grace", 10*time.Second, "time to wait after SIGTERM before sending SIGKILL")
+	procfile := flags.String("procfile", ProcfileName, "file listing the scripts to run when none are given")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	processes := ScriptProcesses(flags.Args())
+	if len(processes) == 0 {
+		var err error
+		if processes, err = ReadProcfile(*procfile); err != nil {
+			return err
+		}
+	}
+	// The scripts are run with the gorun flags given before "up".
+	gorunFlags := os.Args[1 : len(os.Args)-len(args)-1]
+	color := isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	status, err := Up(processes, gorunFlags, *grace, os.Stdout, color)
+	if err != nil {
+		return err
+	}
+	return &exitError{status, nil}
+}
+
+// completionCommand implements "gorun completion --script <file>", which
+// prints shell completion for the arguments of a script.
+func completionCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("completion", flag.ContinueOnError)
+	script := flags.String("script", "", "script to complete arguments for")
+	shell := flags.String("shell", filepath.Base(os.Getenv("SHELL")), "shell to emit completion for (bash, zsh or fish)")
+	name := flags.String("name", "", "command name to complete (defaults to the script file name)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *script == "" {
+		return usageError("completion")
+	}
+	if *name == "" {
+		*name = filepath.Base(*script)
+	}
+	if *shell == "" || *shell == "." {
+		*shell = "bash"
+	}
+	content, err := ioutil.ReadFile(*script)
+	if err != nil {
+		return err
+	}
+	return WriteCompletion(os.Stdout, *shell, *name, content)
+}
+
+// cronCommands maps the "gorun cron" subcommand names to their
+// implementations.
+var cronCommands = map[string]func(opts *Options, args []string) error{
+	"install": cronInstallCommand,
+	"list":    cronListCommand,
+	"remove":  cronRemoveCommand,
+}
+
+// cronCommand implements "gorun cron <command>", which manages the
+// crontab entries running scripts on the schedules of their cron section.
+func cronCommand(opts *Options, args []string) error {
+	if len(args) > 0 {
+		if command, ok := cronCommands[args[0]]; ok {
+			return command(opts, args[1:])
+		}
+	}
+	return usageError("cron")
+}
+
+// cronInstallCommand implements "gorun cron install", which adds the
+// schedules of scripts to the user's crontab.
+func cronInstallCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("cron install", flag.ContinueOnError)
+	gorunFlags := flags.String("flags", "", "gorun flags to run the script with, such as --log-driver=syslog")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: gorun cron install [--flags=flags] <source file> [...]")
+	}
+	for _, sourcefile := range flags.Args() {
+		lines, err := InstallCron(sourcefile, strings.Fields(*gorunFlags))
+		if err != nil {
+			return errors.New(sourcefile + ": " + err.Error())
+		}
+		for _, line := range lines {
+			fmt.Println("installed: " + line)
+		}
+	}
+	return nil
+}
+
+// cronListCommand implements "gorun cron list", which shows the crontab
+// entries installed by gorun.
+func cronListCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("cron list", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	jobs, err := CronJobs()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%s\n", job.Script, job.Line)
+	}
+	return w.Flush()
+}
+
+// cronRemoveCommand implements "gorun cron remove", which removes the
+// crontab entries of scripts.
+func cronRemoveCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("cron remove", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: gorun cron remove <source file> [...]")
+	}
+	for _, sourcefile := range flags.Args() {
+		n, err := RemoveCron(sourcefile)
+		if err != nil {
+			return errors.New(sourcefile + ": " + err.Error())
+		}
+		fmt.Printf("removed %d entries of %s\n", n, sourcefile)
+	}
+	return nil
+}
+
+// hookCommand implements "gorun hook install", which installs a script
+// as a git hook of the repository in the current directory.
+func hookCommand(opts *Options, args []string) error {
+	if len(args) == 0 || args[0] != "install" {
+		return usageError("hook")
+	}
+	flags := flag.NewFlagSet("hook install", flag.ContinueOnError)
+	force := flags.Bool("force", false, "replace a hook not installed by gorun")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return usageError("hook")
+	}
+	hook, err := InstallHook(flags.Arg(0), flags.Arg(1), *force)
+	if err != nil {
+		return err
+	}
+	fmt.Println("installed " + hook)
+	return nil
+}
+
+// cacheCommands maps the "gorun cache" subcommand names to their
+// implementations.
+var cacheCommands = map[string]func(opts *Options, args []string) error{
+	"rm":    cacheRmCommand,
+	"stats": cacheStatsCommand,
+}
+
+// cacheCommand implements "gorun cache <command>", which manages the
+// cache entries of individual scripts.
+func cacheCommand(opts *Options, args []string) error {
+	if len(args) > 0 {
+		if command, ok := cacheCommands[args[0]]; ok {
+			return command(opts, args[1:])
+		}
+	}
+	return usageError("cache")
+}
+
+// cacheRmCommand implements "gorun cache rm", which removes the cache
+// entries of the given scripts, with all the binaries built from them.
+func cacheRmCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("cache rm", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: gorun cache rm <source file> [...]")
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	// As "gorun clean <source file>" does, one script at a time to tell
+	// which were cached.
+	for _, sourcefile := range flags.Args() {
+		removed, busy, err := RemoveEntries(runBaseDir, []string{sourcefile}, false)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(removed) > 0:
+			fmt.Printf("removed %s (%s)\n", filepath.Join(runBaseDir, removed[0].name), formatSize(removed[0].size))
+		case len(busy) > 0:
+			fmt.Printf("left %s, a build is using it\n", filepath.Join(runBaseDir, busy[0].name))
+		default:
+			fmt.Printf("%s is not cached\n", sourcefile)
+		}
+	}
+	return nil
+}
+
+// cacheStatsCommand implements "gorun cache stats", which shows the
+// size of the cache and, with --per-script, the recorded usage metrics
+// of each script, those taking the most time to build first.
+func cacheStatsCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("cache stats", flag.ContinueOnError)
+	perScript := flags.Bool("per-script", false, "show the usage metrics of each script (see GORUN_METRICS)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	if !*perScript {
+		entries, err := cacheEntries(runBaseDir)
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, entry := range entries {
+			total += entry.size
+		}
+		fmt.Printf("cache directory: %s\n", runBaseDir)
+		fmt.Printf("entries: %d\n", len(entries))
+		fmt.Printf("size: %s\n", formatSize(total))
+		return nil
+	}
+	metrics, err := ReadMetrics(MetricsFile(runBaseDir))
+	if err != nil {
+		return err
+	}
+	if len(metrics) == 0 {
+		fmt.Fprintln(os.Stderr, "no metrics recorded, set GORUN_METRICS=1 to record them")
+		return nil
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].BuildTime > metrics[j].BuildTime
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SCRIPT\tRUNS\tBUILDS\tBUILD TIME\tLAST RUN")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", m.Script, m.Runs, m.Builds, m.BuildTime.Round(time.Millisecond), m.LastRun.Format("2006-01-02 15:04:05"))
+	}
+	return w.Flush()
+}
+
+// buildCommand implements "gorun build", which compiles a script into
+// a binary at the given location instead of running it.
+func buildCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	opts.AddCommandFlags(flags)
+	output := flags.String("o", "", "write the binary to this file or directory (defaults to the script name without .go)")
+	universal := flags.Bool("universal", false, "build a macOS universal binary for amd64 and arm64")
+	system := flags.Bool("system", false, "install the binary in the system cache (see GORUN_SYSTEM_CACHE)")
+	shared := flags.Bool("shared", false, "install the binary in the shared cache (see GORUN_SHARED_CACHE)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError("build")
+	}
+	sourcefile := flags.Arg(0)
+	cross := opts.GOOS != "" || opts.GOARCH != ""
+	if *universal && cross {
+		return errors.New("--universal can't be used with --goos or --goarch")
+	}
+	if *system || *shared {
+		if *output != "" || *universal || *system && *shared {
+			return errors.New("--system and --shared can't be used together, nor with -o or --universal")
+		}
+		if cross {
+			return errors.New("--system and --shared install binaries for the host, not --goos or --goarch")
+		}
+		install := InstallSystem
+		if *shared {
+			install = InstallShared
+		}
+		runFile, err := install(opts, sourcefile)
+		if err != nil {
+			return err
+		}
+		fmt.Println("installed " + runFile)
+		return nil
+	}
+	goos := opts.GOOS
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if *output == "" {
+		*output = defaultOutput(sourcefile, goos)
+	} else if stat, err := os.Stat(*output); err == nil && stat.IsDir() {
+		// As with go build, the binary goes in the directory.
+		*output = filepath.Join(*output, defaultOutput(sourcefile, goos))
+	}
+	return BuildTo(opts, sourcefile, *output, *universal)
+}
+
+// releaseCommand implements "gorun release", which builds a script for
+// several platforms into a release directory.
+func releaseCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("release", flag.ContinueOnError)
+	opts.AddCommandFlags(flags)
+	targetList := flags.String("targets", "", "comma-separated GOOS/GOARCH platforms to build for")
+	dist := flags.String("d", "dist", "directory to write the binaries and their checksums to")
+	compress := flags.Bool("gzip", false, "gzip the binaries")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *targetList == "" {
+		return usageError("release")
+	}
+	targets, err := ParseTargets(*targetList)
+	if err != nil {
+		return err
+	}
+	written, err := Release(opts, flags.Arg(0), targets, *dist, *compress)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
+
+// serveWasmCommand implements "gorun serve-wasm", which serves a script
+// built for WebAssembly along with a page running it.
+func serveWasmCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("serve-wasm", flag.ContinueOnError)
+	opts.AddCommandFlags(flags)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError("serve-wasm")
+	}
+	return ServeWasm(opts, flags.Arg(0), *addr)
+}
+
+// verifyCommand implements "gorun verify", which builds a script for
+// several platforms without running it.
+func verifyCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	opts.AddCommandFlags(flags)
+	targetList := flags.String("targets", "", "comma-separated GOOS/GOARCH platforms to build for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *targetList == "" {
+		return usageError("verify")
+	}
+	targets, err := ParseTargets(*targetList)
+	if err != nil {
+		return err
+	}
+	return VerifyTargets(opts, flags.Arg(0), targets, os.Stdout)
+}
+
+// vendorBundleCommand implements "gorun vendor-bundle", which packs the
+// modules a script needs into a bundle for offline builds.
+func vendorBundleCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("vendor-bundle", flag.ContinueOnError)
+	opts.AddCommandFlags(flags)
+	output := flags.String("o", "", "bundle to write: a .tar, .tar.gz, .tgz, .tar.zst or .tar.xz file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *output == "" {
+		return usageError("vendor-bundle")
+	}
+	return VendorBundle(opts, flags.Arg(0), *output)
+}
+
+// fmtCommand implements "gorun fmt", which gofmts scripts in place.
+func fmtCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	list := flags.Bool("l", false, "only list the scripts needing formatting")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageError("fmt")
+	}
+	for _, sourcefile := range flags.Args() {
+		content, err := ioutil.ReadFile(sourcefile)
+		if err != nil {
+			return err
+		}
+		formatted, err := Format(content)
+		if err != nil {
+			return errors.New(sourcefile + ": " + err.Error())
+		}
+		if bytes.Equal(formatted, content) {
+			continue
+		}
+		if *list {
+			fmt.Println(sourcefile)
+			continue
+		}
+		info, err := os.Stat(sourcefile)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(sourcefile, formatted, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packMultiCommand implements "gorun pack-multi", which builds several
+// scripts into a single multi-call binary.
+func packMultiCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("pack-multi", flag.ContinueOnError)
+	opts.AddCommandFlags(flags)
+	output := flags.String("o", "", "write the binary to this file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 || *output == "" {
+		return usageError("pack-multi")
+	}
+	return PackMulti(opts, flags.Args(), *output)
+}
+
+// diffCommand implements "gorun diff", which shows how the dependencies
+// declared by scripts differ from what go mod tidy makes of them.  Like
+// diff, it exits with status 1 when they differ.
+func diffCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageError("diff")
+	}
+	differ := false
+	for _, sourcefile := range flags.Args() {
+		d, err := Diff(opts, sourcefile, os.Stdout)
+		if err != nil {
+			return errors.New(sourcefile + ": " + err.Error())
+		}
+		differ = differ || d
+	}
+	if differ {
+		return &exitError{1, nil}
+	}
+	return nil
+}
+
+// envCommand implements "gorun env", which prints the settings gorun
+// resolves, and those of a script if one is given, or creates and
+// activates environments scoping the cache and default settings.
+func envCommand(opts *Options, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			if len(args) != 2 {
+				return usageError("env")
+			}
+			dir, err := CreateEnv(args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "gorun: created environment "+args[1]+", with its settings in "+dir)
+			return nil
+		case "activate":
+			if len(args) != 2 {
+				return usageError("env")
+			}
+			if stat, err := os.Stat(EnvDir(args[1])); !validEnvName.MatchString(args[1]) || err != nil || !stat.IsDir() {
+				return errors.New("no environment called " + args[1])
+			}
+			fmt.Println("export GORUN_ENV=" + shellQuote(args[1]))
+			return nil
+		case "deactivate":
+			if len(args) != 1 {
+				return usageError("env")
+			}
+			fmt.Println("unset GORUN_ENV")
+			return nil
+		}
+	}
+	flags := flag.NewFlagSet("env", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the settings as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return usageError("env")
+	}
+	vars, err := Env(opts, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return PrintEnv(os.Stdout, vars, *asJSON)
+}
+
+// freezeCommand implements "gorun freeze", which pins the dependencies
+// of scripts in their go.mod and go.sum sections.
+func freezeCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("freeze", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageError("freeze")
+	}
+	for _, sourcefile := range flags.Args() {
+		if err := Freeze(opts, sourcefile); err != nil {
+			return errors.New(sourcefile + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// getCommand implements "gorun get", which adds requirements to the
+// go.mod section of a script and freezes it.
+func getCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return usageError("get")
+	}
+	sourcefile := flags.Arg(0)
+	if err := Get(opts, sourcefile, flags.Args()[1:]); err != nil {
+		return errors.New(sourcefile + ": " + err.Error())
+	}
+	return nil
+}
+
+// replCommand implements "gorun repl", an interactive Go session.
+func replCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("repl", flag.ContinueOnError)
+	modfile := flags.String("mod", "", "script whose go.mod, go.sum and go.env sections to build with")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return Repl(opts, *modfile, os.Stdin)
+}
+
+// lspCommand implements "gorun lsp", which runs gopls for a script.
+func lspCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageError("lsp")
+	}
+	return LSP(opts, flags.Arg(0))
+}
+
+// mdCommand implements "gorun md", which runs the Go code blocks of a
+// Markdown document, or a single one of them.  Arguments for the
+// program follow "--".
+func mdCommand(opts *Options, args []string) error {
+	var scriptArgs []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, scriptArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return usageError("md")
+	}
+	block := ""
+	if len(args) == 2 {
+		block = args[1]
+	}
+	return RunMarkdown(opts, block, append([]string{args[0]}, scriptArgs...))
+}
+
+// warmCommand implements "gorun warm", which downloads the modules
+// needed by scripts without building them.
+func warmCommand(opts *Options, args []string) error {
+	flags := flag.NewFlagSet("warm", flag.ContinueOnError)
+	jobs := flags.Int("j", runtime.NumCPU(), "number of scripts to warm in parallel")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageError("warm")
+	}
+	outs, errs := WarmAll(opts, flags.Args(), *jobs)
+	failed := 0
+	for i, sourcefile := range flags.Args() {
+		os.Stderr.Write(outs[i].Bytes())
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", sourcefile, errs[i])
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.New("failed to warm " + strconv.Itoa(failed) + " scripts")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// goRunValueFlags are the go run flags taking a value, which may be
+// given as the next argument.
+var goRunValueFlags = map[string]bool{
+	"asmflags": true, "C": true, "compiler": true, "covermode": true, "coverpkg": true,
+	"exec": true, "gccgoflags": true, "gcflags": true, "installsuffix": true, "ldflags": true,
+	"mod": true, "modfile": true, "overlay": true, "p": true, "pgo": true, "pkgdir": true,
+	"tags": true, "toolexec": true, "buildmode": true, "buildvcs": true,
+}
+
+// goRunBuildFlags are the go run flags gorun passes on to go build.  Any
+// other flag makes gorun leave the whole command to go run.
+var goRunBuildFlags = map[string]bool{
+	"a": true, "asan": true, "asmflags": true, "buildvcs": true, "cover": true, "covermode": true,
+	"coverpkg": true, "gcflags": true, "ldflags": true, "linkshared": true, "mod": true,
+	"modcacherw": true, "msan": true, "p": true, "race": true, "tags": true, "trimpath": true,
+	"v": true, "x": true,
+}
+
+// GoRun runs args as go run would, args being what follows go run on its
+// command line: build flags, a Go source file and the arguments of the
+// program.  A single source file is run as a script, its binary being
+// cached; anything else, such as packages or several files, is handed
+// over to go run itself.
+func GoRun(opts *Options, args []string) error {
+	var buildFlags []string
+	var wrapper string
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "-"; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		arg := args[i]
+		name := strings.TrimLeft(arg, "-")
+		if j := strings.Index(name, "="); j >= 0 {
+			name = name[:j]
+		} else if goRunValueFlags[name] && i+1 < len(args) {
+			i++
+			arg += "=" + args[i]
+		}
+		switch {
+		case name == "exec":
+			wrapper = arg[strings.Index(arg, "=")+1:]
+		case goRunBuildFlags[name]:
+			buildFlags = append(buildFlags, arg)
+		default:
+			return execGoRun(args)
+		}
+	}
+	files := i
+	for files < len(args) && strings.HasSuffix(args[files], ".go") {
+		files++
+	}
+	if files-i != 1 {
+		return execGoRun(args)
+	}
+	opts.BuildFlags = append(opts.BuildFlags, buildFlags...)
+	opts.ExecWrapper = wrapper
+	return Run(opts, args[i:])
+}
+
+// execGoRun replaces gorun with go run args, or runs it on Windows.
+func execGoRun(args []string) error {
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return err
+	}
+	if !canExec {
+		signal.Ignore(os.Interrupt)
+		cmd := exec.Command(gotool, append([]string{"run"}, args...)...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return &exitError{exitErr.ExitCode(), nil}
+			}
+			return err
+		}
+		// Like the scripts gorun runs, a successful go run ends gorun
+		// with its status.
+		return &exitError{0, nil}
+	}
+	return syscall.Exec(gotool, append([]string{gotool, "run"}, args...), os.Environ())
+}
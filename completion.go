@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// completionWord is a flag or subcommand declared by a script in its
+// completion section, one per line, optionally followed by a
+// description:
+//
+//	// completion >>>
+//	// --verbose  Print more details
+//	// deploy     Deploy the current release
+//	// <<< completion
+type completionWord struct {
+	word        string
+	description string
+}
+
+func completionWords(content []byte) []completionWord {
+	var words []completionWord
+	for _, line := range strings.Split(string(gorun.Section(content, "completion")), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		words = append(words, completionWord{fields[0], strings.Join(fields[1:], " ")})
+	}
+	return words
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// WriteCompletion writes a completion script for the given shell
+// offering the words declared in the completion section of content
+// when completing arguments of the command called name.
+func WriteCompletion(w io.Writer, shell, name string, content []byte) error {
+	words := completionWords(content)
+	if len(words) == 0 {
+		return errors.New("no completion section in script")
+	}
+	fn := "_gorun_" + nonIdentifier.ReplaceAllString(filepath.Base(name), "_")
+	var buf bytes.Buffer
+	switch shell {
+	case "bash":
+		var list []string
+		for _, word := range words {
+			list = append(list, word.word)
+		}
+		fmt.Fprintf(&buf, "%s() {\n", fn)
+		fmt.Fprintf(&buf, "\tCOMPREPLY=($(compgen -W %s -- \"${COMP_WORDS[COMP_CWORD]}\"))\n", shellQuote(strings.Join(list, " ")))
+		fmt.Fprintf(&buf, "}\n")
+		fmt.Fprintf(&buf, "complete -F %s %s\n", fn, shellQuote(name))
+	case "zsh":
+		fmt.Fprintf(&buf, "#compdef %s\n", name)
+		fmt.Fprintf(&buf, "%s() {\n\tlocal -a words\n\twords=(\n", fn)
+		for _, word := range words {
+			spec := strings.Replace(word.word, ":", "\\:", -1)
+			if word.description != "" {
+				spec += ":" + word.description
+			}
+			fmt.Fprintf(&buf, "\t\t%s\n", shellQuote(spec))
+		}
+		fmt.Fprintf(&buf, "\t)\n\t_describe 'arguments' words\n}\n")
+		fmt.Fprintf(&buf, "compdef %s %s\n", fn, shellQuote(name))
+	case "fish":
+		for _, word := range words {
+			fmt.Fprintf(&buf, "complete -c %s", fishQuote(name))
+			switch {
+			case strings.HasPrefix(word.word, "--"):
+				fmt.Fprintf(&buf, " -l %s", fishQuote(strings.TrimPrefix(word.word, "--")))
+			case strings.HasPrefix(word.word, "-") && len(word.word) == 2:
+				fmt.Fprintf(&buf, " -s %s", fishQuote(word.word[1:]))
+			case strings.HasPrefix(word.word, "-"):
+				fmt.Fprintf(&buf, " -o %s", fishQuote(word.word[1:]))
+			default:
+				fmt.Fprintf(&buf, " -f -a %s", fishQuote(word.word))
+			}
+			if word.description != "" {
+				fmt.Fprintf(&buf, " -d %s", fishQuote(word.description))
+			}
+			buf.WriteString("\n")
+		}
+	default:
+		return errors.New("unsupported shell: " + shell)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// shellQuote quotes s for use as a single word in a POSIX-like shell.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`!*?[](){}<>|&;#~") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// fishQuote quotes s for use as a single word in fish.
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
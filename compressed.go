@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsCompressed reports whether sourcefile is a gzip-compressed script,
+// such as script.go.gz.
+func IsCompressed(sourcefile string) bool {
+	return strings.HasSuffix(sourcefile, ".go.gz")
+}
+
+// RunCompressed decompresses the script args[0], which IsCompressed, and
+// runs it with arguments args[1:].  Like piped scripts, the script is
+// saved into the cache under a directory derived from its content, so
+// that it's only rebuilt when it changes.
+func RunCompressed(opts *Options, args []string) error {
+	f, err := os.Open(args[0])
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	safe, err := SafeSourceRequired()
+	if err != nil {
+		return err
+	}
+	if safe {
+		if err := CheckSafeSource(args[0]); err != nil {
+			return err
+		}
+	}
+
+	// The script run is a copy, so check the original.
+	if opts.VerifyManifest {
+		if err := VerifySums(args[0], nil); err != nil {
+			return err
+		}
+		verified := *opts
+		verified.VerifyManifest = false
+		opts = &verified
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.New("can't decompress " + args[0] + ": " + err.Error())
+	}
+	content, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return errors.New("can't decompress " + args[0] + ": " + err.Error())
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	dir := filepath.Join(auxDir(runBaseDir, "compressed"), hex.EncodeToString(sum[:8]))
+	// Keep the name of the script, which it may rely on.
+	sourcefile, err := materialize(dir, strings.TrimSuffix(filepath.Base(args[0]), ".gz"), content)
+	if err != nil {
+		return err
+	}
+	return Run(opts, append([]string{sourcefile}, args[1:]...))
+}
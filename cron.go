@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// cronMarker ends the crontab lines installed by gorun, followed by the
+// path of the script they run.
+const cronMarker = " # gorun:"
+
+// CronJob is a crontab line installed by gorun.
+type CronJob struct {
+	Script string
+	Line   string
+}
+
+// CronSchedules returns the lines of the cron section of a script: a
+// schedule, either five fields or one such as @daily, optionally
+// followed by arguments for the script.
+func CronSchedules(content []byte) ([]string, error) {
+	var schedules []string
+	for _, line := range strings.Split(string(gorun.Section(content, "cron")), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !strings.HasPrefix(fields[0], "@") && len(fields) < 5 {
+			return nil, errors.New("invalid cron schedule: " + line)
+		}
+		schedules = append(schedules, line)
+	}
+	if len(schedules) == 0 {
+		return nil, errors.New("no cron section")
+	}
+	return schedules, nil
+}
+
+// cronLine returns the crontab line running the script at path with
+// gorun on schedule, a line of its cron section, with the gorun flags
+// given.
+func cronLine(gorun, path, schedule string, flags []string) string {
+	fields := strings.Fields(schedule)
+	n := 5
+	if strings.HasPrefix(fields[0], "@") {
+		n = 1
+	}
+	words := append([]string{strings.Join(fields[:n], " "), shellQuote(gorun)}, flags...)
+	words = append(append(words, shellQuote(path)), fields[n:]...)
+	// A % ends the command in crontabs.
+	return strings.Replace(strings.Join(words, " "), "%", `\%`, -1) + cronMarker + path
+}
+
+// readCrontab returns the lines of the user's crontab.
+func readCrontab() ([]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("crontab", "-l")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(stderr.String(), "no crontab") {
+			return nil, nil
+		}
+		return nil, errors.New("crontab -l failed: " + strings.TrimSpace(stderr.String()))
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), nil
+}
+
+// writeCrontab replaces the user's crontab with lines.
+func writeCrontab(lines []string) error {
+	cmd := exec.Command("crontab", "-")
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("crontab failed: " + err.Error())
+	}
+	return nil
+}
+
+// CronJobs returns the crontab lines installed by gorun.
+func CronJobs() ([]CronJob, error) {
+	lines, err := readCrontab()
+	if err != nil {
+		return nil, err
+	}
+	var jobs []CronJob
+	for _, line := range lines {
+		if i := strings.LastIndex(line, cronMarker); i >= 0 {
+			jobs = append(jobs, CronJob{Script: line[i+len(cronMarker):], Line: line[:i]})
+		}
+	}
+	return jobs, nil
+}
+
+// InstallCron adds the schedules of the cron section of sourcefile to
+// the user's crontab, replacing those installed for it before, running
+// it with the gorun flags given.  It returns the lines installed.
+func InstallCron(sourcefile string, flags []string) ([]string, error) {
+	content, err := ioutil.ReadFile(sourcefile)
+	if err != nil {
+		return nil, err
+	}
+	schedules, err := CronSchedules(content)
+	if err != nil {
+		return nil, err
+	}
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return nil, err
+	}
+	gorun, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	lines, err := readCrontab()
+	if err != nil {
+		return nil, err
+	}
+	lines = withoutCronJobs(lines, path)
+	var installed []string
+	for _, schedule := range schedules {
+		installed = append(installed, cronLine(gorun, path, schedule, flags))
+	}
+	return installed, writeCrontab(append(lines, installed...))
+}
+
+// RemoveCron removes the crontab lines installed for sourcefile, and
+// returns how many there were.
+func RemoveCron(sourcefile string) (int, error) {
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return 0, err
+	}
+	lines, err := readCrontab()
+	if err != nil {
+		return 0, err
+	}
+	kept := withoutCronJobs(lines, path)
+	if len(kept) == len(lines) {
+		return 0, nil
+	}
+	return len(lines) - len(kept), writeCrontab(kept)
+}
+
+// withoutCronJobs returns lines without those installed for the script
+// at path.
+func withoutCronJobs(lines []string, path string) []string {
+	var kept []string
+	for _, line := range lines {
+		if !strings.HasSuffix(line, cronMarker+path) {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
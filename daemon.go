@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Daemonize starts runFile in the background with arguments args,
+// args[0] being what the script sees as its name, in a session of its
+// own detached from the terminal.  Its output is appended to
+// opts.DaemonLog, or to the script's name with .log in the current
+// directory, and its pid is written to opts.PidFile if set.
+func Daemonize(runFile string, args []string, opts *Options) error {
+	if opts.PidFile != "" {
+		if pid := readPidFile(opts.PidFile); pid > 0 && processAlive(pid) {
+			return &exitError{ExitFailure, errors.New(args[0] + " is already running with pid " + strconv.Itoa(pid))}
+		}
+	}
+	logFile := opts.DaemonLog
+	if logFile == "" {
+		logFile = strings.TrimSuffix(filepath.Base(args[0]), ".go") + ".log"
+	}
+	log, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+
+	cmd := exec.Command(runFile, args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Stdin = null
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = detached()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	trackRun(pid, runFile, args, opts)
+	if opts.PidFile != "" {
+		if err := writePidFile(opts.PidFile, pid); err != nil {
+			return err
+		}
+	}
+	return &exitError{0, nil}
+}
+
+// readPidFile returns the pid recorded in path, or 0 if there's none.
+func readPidFile(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// writePidFile atomically records pid in path.
+func writePidFile(path string, pid int) error {
+	tmp := path + "." + strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
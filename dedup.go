@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// ObjectFile returns the path under runBaseDir where the binary built
+// with the settings identified by key from the script with the given
+// header (see scanScript) and hash is shared by all the scripts with
+// that same content, wherever they are.  It returns "" for
+// scripts whose binary depends on files next to them, through embedding,
+// cgo, included files or relative replace directives, as copies elsewhere
+// may differ.
+func ObjectFile(runBaseDir string, header []byte, sum string, key []string) string {
+	if bytes.Contains(header, []byte("//go:embed")) || bytes.Contains(header, []byte(`import "C"`)) || bytes.Contains(header, []byte("//gorun:include")) {
+		return ""
+	}
+	for _, line := range strings.Split(string(gorun.Section(header, "go.mod")), "\n") {
+		if i := strings.Index(line, "=>"); i >= 0 && strings.HasPrefix(strings.TrimSpace(line[i+2:]), ".") {
+			return ""
+		}
+	}
+	h := sha256.Sum256([]byte(sum + "\x00" + strings.Join(key, "\n")))
+	return filepath.Join(auxDir(runBaseDir, "objects"), hex.EncodeToString(h[:])+".gorun")
+}
+
+// LinkObject makes runFile, the binary of the script whose source was
+// stat'ed as sstat, a hard link to the shared binary objFile if it was
+// built in the build environment env and, unless verify is VerifyOff,
+// matches its recorded hash.  It reports whether it did.
+func LinkObject(objFile, runFile string, sstat os.FileInfo, env Meta, verify string) bool {
+	ostat, err := os.Stat(objFile)
+	if err != nil {
+		return false
+	}
+	meta, err := ReadMeta(objFile)
+	if err != nil || !meta.SameBuildEnvironment(env) || meta.DynamicLinkingChanged() {
+		return false
+	}
+	if verify != VerifyOff && VerifyBinary(objFile) != nil {
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(runFile), 0700); err != nil {
+		return false
+	}
+	if err := copyFile(MetaFile(objFile), MetaFile(runFile), 0600); err != nil {
+		return false
+	}
+	tmp := runFile + "." + strconv.Itoa(os.Getpid())
+	os.Remove(tmp)
+	if err := os.Link(objFile, tmp); err != nil {
+		return false
+	}
+	if err := os.Rename(tmp, runFile); err != nil {
+		os.Remove(tmp)
+		return false
+	}
+	// Links share their modification time, which must not be older than
+	// any of the identical sources for the binary to be up to date.
+	if ostat.ModTime().Before(sstat.ModTime()) {
+		os.Chtimes(objFile, sstat.ModTime(), sstat.ModTime())
+	}
+	os.Chtimes(filepath.Dir(objFile), sstat.ModTime(), sstat.ModTime())
+	return true
+}
+
+// StoreObject shares the freshly built runFile as objFile, for the
+// identical scripts found elsewhere.  It's best effort.
+func StoreObject(objFile, runFile string) {
+	if err := os.MkdirAll(filepath.Dir(objFile), 0700); err != nil {
+		return
+	}
+	if err := copyFile(MetaFile(runFile), MetaFile(objFile), 0600); err != nil {
+		return
+	}
+	tmp := objFile + "." + strconv.Itoa(os.Getpid())
+	os.Remove(tmp)
+	if err := os.Link(runFile, tmp); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, objFile); err != nil {
+		os.Remove(tmp)
+	}
+}
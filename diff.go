@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// Diff writes to w how the go.mod and go.sum sections of sourcefile, or
+// the go.mod referenced by its //gorun:gomod pragma, differ from what go
+// mod tidy makes of the script, as unified diffs.  It reports whether
+// they differ.
+func Diff(opts *Options, sourcefile string, w io.Writer) (bool, error) {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return false, &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return false, err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return false, err
+	}
+	tidied, err := tidyModule(build, sourcefile, content, nil)
+	if err != nil {
+		return false, err
+	}
+	declared := map[string][]byte{"go.mod": build.GoMod, "go.sum": build.GoSum}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		if section := gorun.Section(content, name); len(section) > 0 {
+			declared[name] = section
+		}
+	}
+	if len(declared["go.mod"]) == 0 && !strings.Contains(string(tidied["go.mod"]), "require") {
+		// Nothing to declare for a script only using the standard library.
+		return false, nil
+	}
+	differ := false
+	for _, name := range []string{"go.mod", "go.sum"} {
+		diff := unifiedDiff(sourcefile+" ("+name+")", "go mod tidy ("+name+")",
+			diffLines(declared[name]), diffLines(tidied[name]))
+		if diff != "" {
+			differ = true
+			if _, err := io.WriteString(w, diff); err != nil {
+				return differ, err
+			}
+		}
+	}
+	return differ, nil
+}
+
+// diffLines splits data into lines, ignoring leading and trailing blank
+// lines, which sections don't keep.
+func diffLines(data []byte) []string {
+	text := strings.Trim(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// unifiedDiff returns the unified diff, with 3 lines of context, turning
+// the lines a into the lines b, or "" if they're the same.
+func unifiedDiff(nameA, nameB string, a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// The edit script, one of ' ', '-' or '+' and the line each.
+	type edit struct {
+		op   byte
+		line string
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+
+	const context = 3
+	var buf strings.Builder
+	for start := 0; start < len(edits); {
+		// Find the next change and the extent of its hunk, merging the
+		// changes closer than twice the context.
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		last := first
+		for k := first; k < len(edits) && k <= last+2*context; k++ {
+			if edits[k].op != ' ' {
+				last = k
+			}
+		}
+		from, to := first-context, last+context+1
+		if from < start {
+			from = start
+		}
+		if to > len(edits) {
+			to = len(edits)
+		}
+		// Line numbers of the hunk in a and b.
+		lineA, lineB := 1, 1
+		for _, e := range edits[:from] {
+			if e.op != '+' {
+				lineA++
+			}
+			if e.op != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		if countA == 0 {
+			lineA--
+		}
+		if countB == 0 {
+			lineB--
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+		for _, e := range edits[from:to] {
+			buf.WriteString(string(e.op) + e.line + "\n")
+		}
+		start = to
+	}
+	return buf.String()
+}
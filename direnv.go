@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// LoadDirenv adds the environment that direnv loads from the .envrc of
+// the directory of sourcefile to gorun's, so that the script sees it as
+// it would in an interactive shell.  Nothing is loaded if direnv isn't
+// installed, there's no .envrc, or the .envrc isn't allowed.
+func LoadDirenv(sourcefile string) error {
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(filepath.Join(dir, ".envrc")); err != nil {
+		return nil
+	}
+	direnv, err := exec.LookPath("direnv")
+	if err != nil {
+		return nil
+	}
+	cmd := exec.Command(direnv, "export", "json")
+	cmd.Dir = dir
+	// Quiet, as the script's own output follows.
+	cmd.Env = append(os.Environ(), "DIRENV_LOG_FORMAT=")
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.New("direnv failed: " + err.Error())
+	}
+	if len(out) == 0 {
+		// Not allowed, or already loaded.
+		return nil
+	}
+	var diff map[string]*string
+	if err := json.Unmarshal(out, &diff); err != nil {
+		return errors.New("unexpected direnv output: " + err.Error())
+	}
+	for name, value := range diff {
+		if strings.HasPrefix(name, "DIRENV_") {
+			// direnv's own state is for shells.
+			continue
+		}
+		if value == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+package main
+
+import "os"
+import "syscall"
+
+// dupStdin makes f the standard input of the process.  Some Linux
+// architectures only have dup3.
+func dupStdin(f *os.File) error {
+	return syscall.Dup3(int(f.Fd()), 0, 0)
+}
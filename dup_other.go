@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import "os"
+import "syscall"
+
+// dupStdin makes f the standard input of the process.
+func dupStdin(f *os.File) error {
+	return syscall.Dup2(int(f.Fd()), 0)
+}
@@ -0,0 +1,19 @@
+package main
+
+import "os"
+import "syscall"
+
+// dupStdin makes f the standard input of the process.  Scripts running
+// as child processes on Windows, they get os.Stdin as theirs.
+func dupStdin(f *os.File) error {
+	p, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	var h syscall.Handle
+	if err := syscall.DuplicateHandle(p, syscall.Handle(f.Fd()), p, &h, 0, true, syscall.DUPLICATE_SAME_ACCESS); err != nil {
+		return err
+	}
+	os.Stdin = os.NewFile(uintptr(h), os.Stdin.Name())
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// encryptedExts are the extensions of encrypted scripts, with the
+// commands printing their plaintext.
+var encryptedExts = map[string]func(sourcefile string) *exec.Cmd{
+	".go.age": func(sourcefile string) *exec.Cmd {
+		return exec.Command("age", "--decrypt", "--identity", ageIdentity(), sourcefile)
+	},
+	".go.gpg": func(sourcefile string) *exec.Cmd {
+		return exec.Command("gpg", "--quiet", "--decrypt", sourcefile)
+	},
+}
+
+// ageIdentity returns the age identity file encrypted scripts are
+// decrypted with: GORUN_AGE_IDENTITY, or else age-identity.txt in the
+// gorun configuration directory.
+func ageIdentity() string {
+	if identity := os.Getenv("GORUN_AGE_IDENTITY"); identity != "" {
+		return identity
+	}
+	return filepath.Join(configDir(), "age-identity.txt")
+}
+
+// encryptedExt returns the extension of sourcefile if it's an encrypted
+// script, or "".
+func encryptedExt(sourcefile string) string {
+	for ext := range encryptedExts {
+		if strings.HasSuffix(sourcefile, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// IsEncrypted reports whether sourcefile is an encrypted script, such
+// as script.go.age.
+func IsEncrypted(sourcefile string) bool {
+	return encryptedExt(sourcefile) != ""
+}
+
+// RunEncrypted decrypts the script args[0], which IsEncrypted, and runs
+// it with arguments args[1:].  The plaintext never goes to the shared
+// temporary directory: the script is decrypted into a private directory
+// under XDG_RUNTIME_DIR, usually kept in memory, which is also made the
+// TMPDIR of gorun, so that the build happens and the binary is cached
+// there.  The plaintext is removed once built, and the script runs with
+// the TMPDIR gorun was given.
+func RunEncrypted(opts *Options, args []string) error {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return errors.New("running encrypted scripts needs XDG_RUNTIME_DIR, a private directory to build them in")
+	}
+	private := filepath.Join(runtimeDir, "gorun")
+	if err := os.MkdirAll(private, 0700); err != nil {
+		return err
+	}
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return &exitError{ExitNotFound, err}
+	}
+
+	safe, err := SafeSourceRequired()
+	if err != nil {
+		return err
+	}
+	if safe {
+		if err := CheckSafeSource(path); err != nil {
+			return err
+		}
+	}
+
+	// The script run is a copy, so check the original.
+	if opts.VerifyManifest {
+		if err := VerifySums(path, nil); err != nil {
+			return err
+		}
+		verified := *opts
+		verified.VerifyManifest = false
+		opts = &verified
+	}
+
+	ext := encryptedExt(path)
+	var stdout bytes.Buffer
+	cmd := encryptedExts[ext](path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("can't decrypt " + args[0] + ": " + err.Error())
+	}
+	plaintext := stdout.Bytes()
+
+	sum := sha256.Sum256([]byte(path))
+	dir := filepath.Join(private, "scripts", hex.EncodeToString(sum[:8]))
+	sourcefile := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), ext)+".go")
+	tmpdir, hadTmpdir := os.LookupEnv("TMPDIR")
+	cleanup := func() {
+		os.Remove(sourcefile)
+		if hadTmpdir {
+			os.Setenv("TMPDIR", tmpdir)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+	}
+	// Also when the build fails.
+	defer cleanup()
+	// The binary is only rebuilt if the plaintext changed, whatever
+	// its modification time.
+	if _, err := materialize(dir, filepath.Base(sourcefile), plaintext); err != nil {
+		return err
+	}
+	if err := os.Setenv("TMPDIR", private); err != nil {
+		return err
+	}
+	decrypted := *opts
+	decrypted.cleanup = cleanup
+	return Run(&decrypted, append([]string{sourcefile}, args[1:]...))
+}
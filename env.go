@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// EnvVar is a setting reported by gorun env.  List settings have their
+// items in List, never nil, rather than Value.
+type EnvVar struct {
+	Name  string
+	Value string
+	List  []string
+}
+
+// Env returns the settings gorun resolves from its flags, environment
+// and configuration files, and, if sourcefile isn't empty, the ones it
+// would build and run that script with.
+func Env(opts *Options, sourcefile string) ([]EnvVar, error) {
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return nil, err
+	}
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return nil, err
+	}
+	version, err := GoVersion(gotool)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := DefaultFlags()
+	if err != nil {
+		return nil, err
+	}
+	var configFiles []string
+	if dir := configDir(); dir != "" {
+		if _, err := os.Stat(filepath.Join(dir, "flags")); err == nil {
+			configFiles = append(configFiles, filepath.Join(dir, "flags"))
+		}
+	}
+	if env, err := ActiveEnv(); err == nil && env != "" {
+		for _, file := range []string{"flags", "pragmas"} {
+			if _, err := os.Stat(filepath.Join(EnvDir(env), file)); err == nil {
+				configFiles = append(configFiles, filepath.Join(EnvDir(env), file))
+			}
+		}
+	}
+	if manifest, err := FindManifest("."); err == nil {
+		configFiles = append(configFiles, manifest)
+	}
+	safe, err := SafeSourceRequired()
+	if err != nil {
+		return nil, err
+	}
+	verify, err := VerifyMode()
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := MetricsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	maxBuilds, err := MaxBuilds()
+	if err != nil {
+		return nil, err
+	}
+	vars := []EnvVar{
+		{Name: "GORUN_ENV", Value: os.Getenv("GORUN_ENV")},
+		{Name: "GORUN_CACHE_DIR", Value: runBaseDir},
+		{Name: "GORUN_GO", Value: gotool},
+		{Name: "GORUN_GOVERSION", Value: version},
+		{Name: "GORUN_CONFIG_FILES", List: list(configFiles)},
+		{Name: "GORUN_FLAGS", List: list(defaults)},
+		{Name: "GORUN_CACHE_MAX_SIZE", Value: os.Getenv("GORUN_CACHE_MAX_SIZE")},
+		{Name: "GORUN_MAX_BUILDS", Value: strconv.Itoa(maxBuilds)},
+		{Name: "GORUN_SAFE_SOURCE", Value: boolValue(safe)},
+		{Name: "GORUN_VERIFY", Value: verify},
+		{Name: "GORUN_METRICS", Value: boolValue(metrics)},
+		{Name: "GORUN_SYSTEM_CACHE", Value: SystemCacheDir()},
+		{Name: "GORUN_SHARED_CACHE", Value: SharedCacheDir()},
+		{Name: "GORUN_MODCACHE", Value: os.Getenv("GORUN_MODCACHE")},
+	}
+	if sourcefile == "" {
+		return vars, nil
+	}
+
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return nil, &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return nil, err
+	}
+	_, runFile, _, err := RunFilePaths(sourcefile, build)
+	if err != nil {
+		return nil, err
+	}
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return nil, err
+	}
+	var pragmas []string
+	for _, pragma := range Pragmas(content) {
+		pragmas = append(pragmas, strings.TrimSpace(pragma.Name+" "+strings.Join(pragma.Args, " ")))
+	}
+	return append(vars,
+		EnvVar{Name: "GORUN_SCRIPT", Value: path},
+		EnvVar{Name: "GORUN_BINARY", Value: runFile},
+		EnvVar{Name: "GORUN_PRAGMAS", List: list(pragmas)},
+		EnvVar{Name: "GORUN_BUILD_FLAGS", List: list(build.Flags)},
+		EnvVar{Name: "GORUN_BUILD_ENV", List: list(append(ExpandGoEnv(gorun.Section(content, "go.env")), build.Env...))},
+		EnvVar{Name: "GORUN_BUILD_KEY", List: list(build.Key)},
+	), nil
+}
+
+// list returns items, or an empty list if it's nil.
+func list(items []string) []string {
+	if items == nil {
+		return []string{}
+	}
+	return items
+}
+
+func boolValue(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// PrintEnv writes vars to w, as a JSON object or as NAME=value lines
+// that a shell can evaluate, the items of lists being separated by
+// newlines, as they may contain spaces.
+func PrintEnv(w io.Writer, vars []EnvVar, asJSON bool) error {
+	if asJSON {
+		object := map[string]interface{}{}
+		for _, v := range vars {
+			if v.List != nil {
+				object[v.Name] = v.List
+			} else {
+				object[v.Name] = v.Value
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(object)
+	}
+	for _, v := range vars {
+		value := v.Value
+		if v.List != nil {
+			value = strings.Join(v.List, "\n")
+		}
+		if _, err := fmt.Fprintln(w, v.Name+"="+shellQuote(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// validEnvName matches the names of gorun environments, which end up in
+// paths.
+var validEnvName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// envFiles are the files of a new environment.
+var envFiles = map[string]string{
+	"flags": "# Default gorun flags in this environment, after those of the user.\n",
+	"pragmas": "# Default pragmas in this environment, such as //gorun:profile release.\n" +
+		"# Pragmas in scripts take precedence.\n",
+}
+
+// EnvDir returns the configuration directory of the environment called
+// name.
+func EnvDir(name string) string {
+	return filepath.Join(configDir(), "envs", name)
+}
+
+// ActiveEnv returns the name of the environment activated by GORUN_ENV,
+// or "" if there's none.
+func ActiveEnv() (string, error) {
+	name := os.Getenv("GORUN_ENV")
+	if name == "" {
+		return "", nil
+	}
+	if !validEnvName.MatchString(name) {
+		return "", errors.New("invalid GORUN_ENV: " + name)
+	}
+	if stat, err := os.Stat(EnvDir(name)); err != nil || !stat.IsDir() {
+		return "", errors.New("no environment called " + name + ", create it with gorun env create " + name)
+	}
+	return name, nil
+}
+
+// CreateEnv creates the environment called name, returning the directory
+// holding its settings.
+func CreateEnv(name string) (string, error) {
+	if !validEnvName.MatchString(name) {
+		return "", errors.New("invalid environment name: " + name)
+	}
+	if configDir() == "" {
+		return "", errors.New("no configuration directory to create environments in")
+	}
+	dir := EnvDir(name)
+	if _, err := os.Stat(dir); err == nil {
+		return "", errors.New("environment " + name + " exists already: " + dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	for file, content := range envFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// envSettings returns the content of the settings file called file of
+// the active environment, if any.
+func envSettings(file string) ([]byte, error) {
+	name, err := ActiveEnv()
+	if err != nil || name == "" {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(EnvDir(name), file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// envModCache returns the module cache of the active environment, or ""
+// if there's none.
+func envModCache() (string, error) {
+	name, err := ActiveEnv()
+	if err != nil || name == "" {
+		return "", err
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gorun", "envs", name, "mod"), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"go/format"
+	"strconv"
+	"strings"
+)
+
+// Format gofmts the Go code in a script, leaving its shebang line and
+// the contents of its embedded sections alone.  The section lines are
+// re-indented as a plain "// " comment each.
+func Format(content []byte) ([]byte, error) {
+	lines := strings.Split(string(content), "\n")
+	var shebang string
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#!") {
+		shebang = lines[0]
+		lines[0] = "//gorun:fmt-shebang"
+	}
+
+	// Hide the sections from gofmt, which may reflow them as doc comments.
+	var sections [][]string
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		name, ok := sectionStart(lines[i])
+		if !ok {
+			out = append(out, lines[i])
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "// <<< "+name {
+			end++
+		}
+		if end == len(lines) {
+			// Not terminated, so not a section either.
+			out = append(out, lines[i])
+			continue
+		}
+		section := []string{"// " + name + " >>>"}
+		for _, line := range lines[i+1 : end] {
+			line = strings.TrimPrefix(strings.TrimSpace(line), "//")
+			line = strings.TrimPrefix(line, " ")
+			if line == "" {
+				section = append(section, "//")
+			} else {
+				section = append(section, "// "+line)
+			}
+		}
+		section = append(section, "// <<< "+name)
+		out = append(out, "//gorun:fmt-section "+strconv.Itoa(len(sections)))
+		sections = append(sections, section)
+		i = end
+	}
+
+	formatted, err := format.Source([]byte(strings.Join(out, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	lines = strings.Split(string(formatted), "\n")
+	out = out[:0]
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "//gorun:fmt-shebang":
+			out = append(out, shebang)
+		case strings.HasPrefix(trimmed, "//gorun:fmt-section "):
+			n, _ := strconv.Atoi(strings.TrimPrefix(trimmed, "//gorun:fmt-section "))
+			out = append(out, sections[n]...)
+		default:
+			out = append(out, line)
+		}
+	}
+	return []byte(strings.Join(out, "\n")), nil
+}
+
+// sectionStart returns the name of the section started by line, if any.
+func sectionStart(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "// ") || !strings.HasSuffix(line, " >>>") {
+		return "", false
+	}
+	name := strings.TrimSpace(line[3 : len(line)-4])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// Freeze resolves the dependencies of sourcefile, including requirements
+// of versions such as latest, with go mod tidy and writes the resulting
+// go.mod and go.sum back into the script as sections, so that it builds
+// the same way from then on.
+func Freeze(opts *Options, sourcefile string) error {
+	return Get(opts, sourcefile, nil)
+}
+
+// Get adds requirements, module paths with an optional @version as with
+// go get, to the go.mod section of sourcefile and freezes it, recording
+// the checksums of all the modules it needs in its go.sum section, once
+// it's checked that the script builds with them.
+func Get(opts *Options, sourcefile string, requirements []string) error {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(sourcefile)
+	if err != nil {
+		return err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return err
+	}
+	tidied, err := tidyModule(build, sourcefile, content, requirements)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		if section, ok := tidied[name]; ok {
+			content = replaceSection(content, name, section)
+		}
+	}
+	return ioutil.WriteFile(sourcefile, content, info.Mode().Perm())
+}
+
+// tidyModule returns the go.mod and go.sum files, by name, that go mod
+// tidy makes of the module of sourcefile, whose content is given and
+// built with build, once requirements are added to it with go get.
+// With requirements, the script is also built with the result to check
+// it's complete.
+func tidyModule(build *BuildSettings, sourcefile string, content []byte, requirements []string) (map[string][]byte, error) {
+	tmp, err := ioutil.TempDir("", "gorun-freeze-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	source := bytes.TrimPrefix(content, utf8BOM)
+	writtenMod, _, err := writeModule(source, build, tmp)
+	if err != nil {
+		return nil, err
+	}
+	if !writtenMod {
+		module := "module " + strings.TrimSuffix(filepath.Base(sourcefile), ".go") + "\n"
+		if err := ioutil.WriteFile(filepath.Join(tmp, "go.mod"), []byte(module), 0600); err != nil {
+			return nil, err
+		}
+	}
+	source = gorun.GoSource(source)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "main.go"), source, 0600); err != nil {
+		return nil, err
+	}
+	// The included files need their dependencies too.
+	for _, include := range build.Includes {
+		if err := copyFile(include, filepath.Join(tmp, filepath.Base(include)), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	var env []string
+	if section := gorun.Section(content, "go.env"); len(section) > 0 || len(build.Env) > 0 {
+		env = append(append(os.Environ(), ExpandGoEnv(section)...), build.Env...)
+	}
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return nil, err
+	}
+	// The //gorun:require pragmas end up in the go.mod section.
+	requirements = append(build.Requires[:len(build.Requires):len(build.Requires)], requirements...)
+	if len(requirements) > 0 {
+		if err := Exec(tmp, env, append([]string{gotool, "get"}, requirements...)); err != nil {
+			return nil, err
+		}
+	}
+	if err := Exec(tmp, env, []string{gotool, "mod", "tidy"}); err != nil {
+		return nil, err
+	}
+	if len(requirements) > 0 {
+		if err := Exec(tmp, env, []string{gotool, "build", "-mod=readonly", "-o", filepath.Join(tmp, "bin"), "."}); err != nil {
+			return nil, errors.New("doesn't build with the new requirements: " + err.Error())
+		}
+		mod, err := ioutil.ReadFile(filepath.Join(tmp, "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		for _, requirement := range requirements {
+			path := requirement
+			if i := strings.Index(path, "@"); i >= 0 {
+				path = path[:i]
+			}
+			if !bytes.Contains(mod, []byte(path+" ")) {
+				return nil, errors.New("doesn't import " + path + ", which go mod tidy would drop; import it first")
+			}
+		}
+	}
+
+	tidied := map[string][]byte{}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		data, err := ioutil.ReadFile(filepath.Join(tmp, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tidied[name] = data
+	}
+	return tidied, nil
+}
+
+// replaceSection returns content with the section called name holding
+// section, replacing the existing one.  A new section is added after the
+// other sections, or at the top of the script, after its bang line if
+// it has one.
+func replaceSection(content []byte, name string, section []byte) []byte {
+	lines := strings.Split(string(content), "\n")
+	embedded := strings.Split(strings.TrimSuffix(string(embedSection(name, section)), "\n"), "\n")
+	for i := range embedded {
+		if embedded[i] == "// " {
+			embedded[i] = "//"
+		}
+	}
+	start, end, last := -1, -1, -1
+	current := ""
+	for i, line := range lines {
+		if current == "" {
+			if sectionName, ok := sectionStart(line); ok {
+				current = sectionName
+				if sectionName == name {
+					start = i
+				}
+			}
+		} else if strings.TrimSpace(line) == "// <<< "+current {
+			if current == name {
+				end = i
+			}
+			current, last = "", i
+		}
+	}
+	var out []string
+	switch {
+	case start >= 0 && end >= 0:
+		out = append(append(append(out, lines[:start]...), embedded...), lines[end+1:]...)
+	case last >= 0:
+		out = append(append(append(out, lines[:last+1]...), embedded...), lines[last+1:]...)
+	default:
+		at := 0
+		if len(lines) > 0 && (strings.HasPrefix(lines[0], "#!") || strings.HasPrefix(lines[0], "///")) {
+			at = 1
+		}
+		out = append(append(append(append(out, lines[:at]...), embedded...), ""), lines[at:]...)
+	}
+	return []byte(strings.Join(out, "\n"))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// gomodTTL is how long a go.mod fetched for the //gorun:gomod pragma is
+// used before being fetched again.
+const gomodTTL = time.Hour
+
+// ExternalGoMod returns the go.mod referenced by the //gorun:gomod
+// pragma of sourcefile, ref being a URL or a path relative to the
+// script, along with the go.sum next to it if there's one.  Fetched
+// files are cached for gomodTTL, and used beyond that when they can't
+// be fetched again.
+func ExternalGoMod(sourcefile, ref string) (mod, sum []byte, err error) {
+	sumRef := ""
+	if strings.HasSuffix(ref, "go.mod") {
+		sumRef = strings.TrimSuffix(ref, "go.mod") + "go.sum"
+	}
+	if !strings.HasPrefix(ref, "https://") && !strings.HasPrefix(ref, "http://") {
+		if !filepath.IsAbs(ref) {
+			ref = filepath.Join(filepath.Dir(sourcefile), ref)
+			sumRef = filepath.Join(filepath.Dir(sourcefile), sumRef)
+		}
+		if mod, err = ioutil.ReadFile(ref); err != nil {
+			return nil, nil, err
+		}
+		if sumRef != "" {
+			sum, _ = ioutil.ReadFile(sumRef)
+		}
+		return mod, sum, nil
+	}
+	if mod, err = fetchCached(ref); err != nil {
+		return nil, nil, err
+	}
+	if len(mod) == 0 {
+		return nil, nil, errors.New("not found: " + ref)
+	}
+	if sumRef != "" {
+		if sum, err = fetchCached(sumRef); err != nil {
+			return nil, nil, err
+		}
+	}
+	return mod, sum, nil
+}
+
+// fetchCached returns the contents at url, fetched at most gomodTTL ago.
+// Missing contents are returned as empty.
+func fetchCached(url string) ([]byte, error) {
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := auxDir(runBaseDir, "gomod")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(url))
+	cached := filepath.Join(dir, hex.EncodeToString(key[:16]))
+	stat, statErr := os.Stat(cached)
+	if statErr == nil && time.Since(stat.ModTime()) < gomodTTL {
+		return ioutil.ReadFile(cached)
+	}
+
+	data, err := fetch(url)
+	if err != nil {
+		if statErr == nil {
+			// Better stale than nothing.
+			return ioutil.ReadFile(cached)
+		}
+		return nil, err
+	}
+	tmp := cached + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return nil, err
+	}
+	return data, os.Rename(tmp, cached)
+}
+
+func fetch(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return []byte{}, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.New("can't fetch " + url + ": " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// writeModule writes the go.mod and go.sum files of the script with
+// content into dir, from its sections or, if it has none, from the
+// go.mod referenced by its //gorun:gomod pragma as resolved in build.
+func writeModule(content []byte, build *BuildSettings, dir string) (writtenMod, writtenSum bool, err error) {
+	modFile := filepath.Join(dir, "go.mod")
+	sumFile := filepath.Join(dir, "go.sum")
+	os.Remove(modFile)
+	os.Remove(sumFile)
+	if writtenMod, err = writeFileFromComments(content, "go.mod", modFile); err != nil {
+		return
+	}
+	if writtenSum, err = writeFileFromComments(content, "go.sum", sumFile); err != nil {
+		return
+	}
+	if writtenMod || len(build.GoMod) == 0 {
+		return
+	}
+	if err = ioutil.WriteFile(modFile, build.GoMod, 0600); err != nil {
+		return
+	}
+	writtenMod = true
+	if !writtenSum && len(build.GoSum) > 0 {
+		if err = ioutil.WriteFile(sumFile, build.GoSum, 0600); err != nil {
+			return
+		}
+		writtenSum = true
+	}
+	return
+}
+
+// requirePragmas returns the module@version requirements given by the
+// "//gorun:require module version" pragmas in pragmas.
+func requirePragmas(pragmas []Pragma) ([]string, error) {
+	var requires []string
+	for _, pragma := range pragmas {
+		if pragma.Name != "require" {
+			continue
+		}
+		if len(pragma.Args) != 2 {
+			return nil, errors.New("invalid //gorun:require pragma, want a module path and version: " + strings.Join(pragma.Args, " "))
+		}
+		requires = append(requires, pragma.Args[0]+"@"+pragma.Args[1])
+	}
+	return requires, nil
+}
+
+// resolveRequires adds requires to the go.mod in dir with go get, along
+// with the modules they need and the checksums of all of them in go.sum.
+// The output of go get is only shown, on out, if it fails.
+func resolveRequires(gotool, dir string, env, requires []string, out io.Writer) error {
+	var output bytes.Buffer
+	if err := ExecTo(dir, env, append([]string{gotool, "get"}, requires...), &output, &output); err != nil {
+		out.Write(output.Bytes())
+		return errors.New("can't resolve the //gorun:require pragmas: " + err.Error())
+	}
+	return nil
+}
+
+// modCache returns the module cache to build sourcefile with, or "" to
+// leave it to the go tool: the one given with --modcache, the
+// //gorun:modcache pragma, relative to the script, GORUN_MODCACHE, or
+// that of the active environment, in that order.  A GOMODCACHE set by
+// the go.env section of content is replaced with the default module
+// cache if it's not writable.
+func (opts *Options) modCache(sourcefile string, pragmas []Pragma, content []byte) (string, error) {
+	dir := opts.ModCache
+	if dir == "" {
+		if dir = pragmaValue(pragmas, "modcache"); dir != "" && !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(sourcefile), dir)
+		}
+	}
+	if dir == "" {
+		dir = os.Getenv("GORUN_MODCACHE")
+	}
+	if dir == "" {
+		var err error
+		if dir, err = envModCache(); err != nil {
+			return "", err
+		}
+	}
+	if dir != "" {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", err
+		}
+		if !writableDir(dir) {
+			return "", errors.New("module cache isn't writable: " + dir)
+		}
+		return dir, nil
+	}
+	for _, variable := range ExpandGoEnv(gorun.Section(content, "go.env")) {
+		if strings.HasPrefix(variable, "GOMODCACHE=") && !writableDir(variable[len("GOMODCACHE="):]) {
+			dir := defaultModCache()
+			fmt.Fprintln(os.Stderr, "gorun: "+variable+" from go.env isn't writable, using "+dir)
+			return dir, nil
+		}
+	}
+	return "", nil
+}
+
+// writableDir reports whether dir, created if need be, can be written to.
+func writableDir(dir string) bool {
+	if dir == "" || os.MkdirAll(dir, 0755) != nil {
+		return false
+	}
+	stat, err := os.Stat(dir)
+	if err != nil || !stat.IsDir() {
+		return false
+	}
+	euid := os.Geteuid()
+	return euid == 0 || canWrite(stat, euid, os.Getegid())
+}
+
+// defaultModCache returns the module cache the go tool uses when go.env
+// doesn't set one.
+func defaultModCache() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath := filepath.SplitList(os.Getenv("GOPATH"))
+	if len(gopath) > 0 && gopath[0] != "" {
+		return filepath.Join(gopath[0], "pkg", "mod")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "go", "pkg", "mod")
+}
+
+// missingPackage matches the errors of go build about an imported
+// package no required module provides, and lookingUpPackage the lookup
+// of such a package that fails when go.mod can't be updated.
+var (
+	missingPackage   = regexp.MustCompile(`(?:no required module provides|cannot find module providing) package ([^\s;:]+)`)
+	lookingUpPackage = regexp.MustCompile(`finding module for package ([^\s;:]+)`)
+)
+
+// missingModuleHint returns how to fix the missing requirements reported
+// by go build in output when building sourcefile with build, or "" if
+// none is.
+func missingModuleHint(sourcefile string, build *BuildSettings, output []byte) string {
+	var packages []string
+	seen := make(map[string]bool)
+	matches := missingPackage.FindAllSubmatch(output, -1)
+	if bytes.Contains(output, []byte("updates to go.mod needed")) {
+		matches = append(matches, lookingUpPackage.FindAllSubmatch(output, -1)...)
+	}
+	for _, match := range matches {
+		if pkg := string(match[1]); !seen[pkg] {
+			seen[pkg] = true
+			packages = append(packages, pkg)
+		}
+	}
+	if len(packages) == 0 {
+		return ""
+	}
+	missing := "no module required by " + sourcefile + " provides " + strings.Join(packages, ", ")
+	if len(build.Requires) > 0 {
+		return missing + "; add //gorun:require pragmas for the modules providing them"
+	}
+	if len(build.GoMod) > 0 {
+		return missing + "; add the modules providing them to the go.mod shared with //gorun:gomod"
+	}
+	return missing + "; run \"gorun freeze " + shellQuote(sourcefile) + "\" to add the modules it imports to its go.mod section"
+}
@@ -23,50 +23,215 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
+
+	"github.com/erning/gorun/pkg/gorun"
 )
 
 func main() {
-	args := os.Args[1:]
+	var opts Options
+	flags := flag.NewFlagSet("gorun", flag.ContinueOnError)
+	flags.Usage = usage
+	opts.AddFlags(flags)
+	defaults, err := DefaultFlags()
+	if err != nil {
+		exit(err)
+	}
+	if err := flags.Parse(append(defaults, os.Args[1:]...)); err != nil {
+		os.Exit(1)
+	}
+	args := flags.Args()
+
+	if opts.Help {
+		if len(args) == 0 {
+			usage()
+			os.Exit(1)
+		}
+		exit(PrintScriptUsage(os.Stdout, args[0]))
+	}
+
+	if opts.Version {
+		exit(PrintVersion(os.Stdout))
+	}
+
+	if opts.Watch {
+		if len(args) == 0 || len(args) >= len(os.Args) {
+			exit(usageError("run"))
+		}
+		// The child gorun gets the same flags as this one.
+		exit(Watch(os.Args[1:len(os.Args)-len(args)], args))
+	}
 
 	if len(args) == 0 {
 		args = append(args, ".")
 	}
 
-	if args[0] == "-h" || args[0] == "help" || args[0] == "-help" || args[0] == "--help" {
-		fmt.Fprintln(os.Stderr, "usage: gorun <source file> [...]")
+	name := "run"
+	if _, ok := lookupCommand(args[0]); ok {
+		name, args = args[0], args[1:]
+	}
+	err = commands[name].Run(&opts, args)
+	if opts.CI {
+		ReportCI(os.Stderr, err)
+	}
+	if err == flag.ErrHelp {
 		os.Exit(1)
 	}
+	exit(err)
+}
 
-	err := Run(args)
+// exit terminates gorun, reporting err if it's not nil.
+func exit(err error) {
+	if e, ok := err.(*exitError); ok && e.err == nil {
+		// The script ran as a child process and exited.
+		os.Exit(e.code)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error: "+err.Error())
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+	os.Exit(0)
+}
+
+// Exit statuses of gorun itself, chosen like the shell's so they can be
+// told apart from the exit status of the script.
+const (
+	ExitFailure  = 1   // any other gorun failure
+	ExitCompile  = 125 // the script failed to compile
+	ExitExec     = 126 // the compiled script couldn't be executed
+	ExitNotFound = 127 // the script doesn't exist
+)
+
+// exitError is an error gorun should exit with a specific status for.
+// Without an underlying error it's the status of a script that ran in
+// child mode.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return "exit status " + strconv.Itoa(e.code)
+	}
+	return e.err.Error()
+}
+
+// exitCode returns the exit status gorun should terminate with on err.
+func exitCode(err error) int {
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	return ExitFailure
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gorun [flags] <source file> [...]")
+	fmt.Fprintln(os.Stderr, "       gorun [flags] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "       gorun --help <source file>")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", name, commands[name].Summary)
 	}
-	fmt.Fprintln(os.Stderr, "An uncaught error has occurred.")
-	os.Exit(1)
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Use \"gorun help <command>\" for the arguments of a command.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "flags:")
+	flags := flag.NewFlagSet("gorun", flag.ContinueOnError)
+	new(Options).AddFlags(flags)
+	flags.SetOutput(os.Stderr)
+	flags.PrintDefaults()
 }
 
-// Run compiles and links the Go source file on args[0] and
-// runs it with arguments args[1:].
-func Run(args []string) error {
+// Run compiles and links the Go source file on args[0] with the
+// settings in opts and runs it with arguments args[1:].
+func Run(opts *Options, args []string) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
 	sourcefile := args[0]
-	runBaseDir, runFile, runCmdDir, err := RunFilePaths(sourcefile)
+	scan, err := scanScript(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
 	if err != nil {
 		return err
 	}
+	content := scan.header
 
-	compile := false
+	// Before anything the script names gets run.
+	safe, err := SafeSourceRequired()
+	if err != nil {
+		return err
+	}
+	if safe {
+		if err := CheckSafeSource(sourcefile); err != nil {
+			return err
+		}
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return err
+	}
+	if opts.VerifyManifest {
+		if err := VerifySums(sourcefile, build.Includes); err != nil {
+			return err
+		}
+	}
+	if err := opts.PrepareSource(sourcefile, content, build); err != nil {
+		return err
+	}
+	if len(args) > 1 && helpArgs[args[1]] && !opts.CI && hasPragma(Pragmas(content), "usage-on-help") {
+		// Show the documentation before the script gets to answer.
+		os.Stderr.Write(ScriptUsage(content))
+	}
+	runBaseDir, runFile, runCmdDir, err := RunFilePaths(sourcefile, build)
+	if err != nil {
+		return err
+	}
+
+	maxSize, err := CacheMaxSize()
+	if err != nil {
+		return err
+	}
+
+	verify, err := VerifyMode()
+	if err != nil {
+		return err
+	}
+
+	metrics, err := MetricsEnabled()
+	if err != nil {
+		return err
+	}
+
+	// Keeping the work directory is pointless without a build to keep.
+	compile := build.Work || opts.Force
 
 	// Now must be called before Stat of sourcefile below,
 	// so that changing the file between Stat and Chtimes still
@@ -77,6 +242,26 @@ func Run(args []string) error {
 	if err != nil {
 		return err
 	}
+	// The binary is as old as the newest of the files it's built from.
+	modTime, err := newestModTime(sourcefile, build.Includes)
+	if err != nil {
+		return err
+	}
+	sourceSum, err := SourceHash(sourcefile, build.Includes)
+	if err != nil {
+		return err
+	}
+
+	for _, prebuilt := range []string{SystemBinary(sourcefile, build.Key, sourceSum, verify), SharedBinary(sourcefile, build.Key, sourceSum)} {
+		if prebuilt == "" || compile || build.Target != (Target{}) {
+			continue
+		}
+		err := execBinary(opts, prebuilt, args)
+		if _, ok := err.(*exitError); ok {
+			return err
+		}
+		// Unusable after all, so build it as usual.
+	}
 
 	rstat, err := os.Stat(runFile)
 	switch {
@@ -84,64 +269,255 @@ func Run(args []string) error {
 		compile = true
 	case rstat.Mode()&(os.ModeDir|os.ModeSymlink|os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
 		return errors.New("not a file: " + runFile)
-	case rstat.ModTime().Before(sstat.ModTime()) || rstat.Mode().Perm()&0700 != 0700:
+	case rstat.Mode().Perm()&0700 != 0700 || !UpToDate(runFile, rstat, sourceSum, modTime):
 		compile = true
 	default:
 		// We have spare cycles. Maybe remove old files.
-		if err := os.Chtimes(runBaseDir, now, now); err == nil {
-			cDirErr := CleanDir(runBaseDir, now)
-			if cDirErr != nil {
-				return cDirErr
+		// Cleaning happens in the background, so that it doesn't
+		// delay the script.
+		if err := os.Chtimes(runBaseDir, now, now); err == nil && CleanDue(runBaseDir, now) {
+			StartCleaning()
+		}
+	}
+
+	if !compile {
+		gotool, err := gorun.GoTool()
+		if err != nil {
+			return err
+		}
+		meta, err := ReadMeta(runFile)
+		if err == nil && !meta.SameBuildEnvironment(BuildEnvironment(gotool)) {
+			// Built with other settings than the current ones.
+			compile = true
+		}
+		if err == nil && meta.DynamicLinkingChanged() {
+			// Linked against a system that has since been upgraded.
+			compile = true
+		}
+	}
+
+	if !compile && verify != VerifyOff {
+		if err := VerifyBinary(runFile); err != nil {
+			if verify == VerifyEnforce {
+				return err
 			}
+			fmt.Fprintln(os.Stderr, "gorun: "+err.Error()+", rebuilding")
+			compile = true
 		}
 	}
 
-	for retry := 3; retry > 0; retry-- {
+	// Identical scripts elsewhere share their binary, unless it's
+	// granted capabilities, which would go to every link.
+	var objFile string
+	var buildEnv Meta
+	if compile && !build.Work && !opts.Force && build.Capabilities == "" {
+		gotool, err := gorun.GoTool()
+		if err != nil {
+			return err
+		}
+		sum, err := FileHash(sourcefile)
+		if err != nil {
+			return err
+		}
+		objFile = ObjectFile(runBaseDir, content, sum, build.Key)
+		buildEnv = BuildEnvironment(gotool)
+	}
+
+	backoff := opts.ExecBackoff
+	attempt := 1
+	for ; ; attempt++ {
+		var buildTime time.Duration
+		if compile && objFile != "" && attempt == 1 && LinkObject(objFile, runFile, sstat, buildEnv, verify) {
+			// An identical script was built already.
+			compile = false
+		}
 		if compile {
-			err := Compile(sourcefile, runFile, runCmdDir)
+			start := time.Now()
+			compiled, err := compileEntry(sourcefile, runFile, runCmdDir, build, modTime, now, sourceSum)
 			if err != nil {
 				return err
 			}
-			// If sourcefile was changed, will be updated on next run.
-			err = os.Chtimes(runFile, sstat.ModTime(), sstat.ModTime())
-			if err != nil {
-				return err
+			if compiled {
+				buildTime = time.Since(start)
+				if objFile != "" {
+					StoreObject(objFile, runFile)
+				}
+				if maxSize > 0 {
+					err = EvictToSize(runBaseDir, maxSize, filepath.Base(runCmdDir))
+					if err != nil {
+						return err
+					}
+				}
 			}
 		}
 
-		err = syscall.Exec(runFile, args, os.Environ())
-		if os.IsNotExist(err) {
-			// Got cleaned up under our feet.
-			compile = true
-			continue
+		// Mark the entry as recently run for the cache eviction policies.
+		os.Chtimes(runCmdDir, now, now)
+
+		if metrics && attempt == 1 {
+			if err := recordRun(runBaseDir, sourcefile, now, buildTime); err != nil {
+				fmt.Fprintln(os.Stderr, "gorun: can't record metrics: "+err.Error())
+			}
 		}
-		break
+
+		if build.Target != (Target{}) {
+			return &exitError{ExitExec, errors.New("built " + runFile + " for " + build.Target.String() +
+				", which can't run here; use gorun build -o to keep a copy")}
+		}
+
+		if opts.cleanup != nil {
+			opts.cleanup()
+			// Without what it needs, the script can't be built again.
+			opts.ExecAttempts = attempt
+		}
+
+		err = execBinary(opts, runFile, args)
+		if _, ok := err.(*exitError); ok {
+			return err
+		}
+		if !os.IsNotExist(err) && err != syscall.ENOEXEC || attempt == opts.ExecAttempts {
+			break
+		}
+		// Got cleaned up under our feet, or can't be loaded anymore
+		// (a missing ELF interpreter also shows up as not existing).
+		compile = true
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+	return &exitError{ExitExec, fmt.Errorf("can't execute %s (attempt %d of %d): %v", runFile, attempt, opts.ExecAttempts, err)}
+}
+
+// compileEntry compiles sourcefile into runFile, dated modTime, holding
+// the lock of the cache entry runCmdDir so that concurrent runs of the
+// script don't compile it each.  Nothing is done if, while waiting for
+// the lock, another gorun built runFile after since from the sources
+// whose digest is sum.  It reports whether it compiled.
+func compileEntry(sourcefile, runFile, runCmdDir string, build *BuildSettings, modTime, since time.Time, sum string) (bool, error) {
+	lock, err := lockEntry(runCmdDir, true)
 	if err != nil {
-		panic("exec returned but succeeded")
+		return false, err
 	}
-	return err
+	defer lock.Close()
+	if builtSince(runFile, since, sum) {
+		return false, nil
+	}
+	if err := Compile(sourcefile, runFile, runCmdDir, build); err != nil {
+		return false, &exitError{ExitCompile, err}
+	}
+	// If sourcefile was changed, will be updated on next run.
+	if err := os.Chtimes(runFile, modTime, modTime); err != nil {
+		return false, err
+	}
+	if build.Capabilities != "" {
+		if err := ApplyCapabilities(runFile, build.Capabilities); err != nil {
+			// Try again on the next run.
+			os.Remove(runFile)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// builtSince reports whether runFile was built after since from the
+// sources whose digest is sum.
+func builtSince(runFile string, since time.Time, sum string) bool {
+	if _, err := os.Stat(runFile); err != nil {
+		return false
+	}
+	mstat, err := os.Stat(MetaFile(runFile))
+	if err != nil || !mstat.ModTime().After(since) {
+		return false
+	}
+	meta, err := ReadMeta(runFile)
+	return err == nil && meta["source.sha256"] == sum
 }
 
-func getSection(content []byte, sectionName string) (section []byte) {
-	start := "// " + sectionName + " >>>"
-	end := "// <<< " + sectionName
-	startIdx := bytes.Index(content, []byte(start))
-	if startIdx >= 0 {
-		idxEnd := bytes.Index(content, []byte(end))
-		if idxEnd > startIdx {
-			goMod := string(content[startIdx+len(start) : idxEnd])
-			goMod = strings.ReplaceAll(goMod, "\n// ", "\n")
-			goMod = strings.ReplaceAll(goMod, "\n//", "\n")
-			return []byte(goMod)
+// newestModTime returns the modification time of the newest of
+// sourcefile and its included files.
+func newestModTime(sourcefile string, includes []string) (time.Time, error) {
+	var newest time.Time
+	for _, path := range append([]string{sourcefile}, includes...) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return newest, err
+		}
+		if stat.ModTime().After(newest) {
+			newest = stat.ModTime()
 		}
 	}
-	return []byte("")
+	return newest, nil
 }
 
+// execBinary runs runFile with arguments args, args[0] being what the
+// script sees as its name.  gorun is replaced with it, except when opts
+// require running it as a child process or a daemon, and on Windows,
+// where processes can't be replaced and it always runs as a child.  Once
+// the script has run as a child, its exit status is returned as an
+// *exitError, as is a zero status once a daemon started; any other error
+// means the binary couldn't be run.
+func execBinary(opts *Options, runFile string, args []string) error {
+	setBuildMetadata(runFile)
+	if opts.Direnv {
+		if err := LoadDirenv(args[0]); err != nil {
+			return &exitError{ExitFailure, err}
+		}
+	}
+	if opts.Record != "" {
+		if err := writeRecording(opts, runFile, args); err != nil {
+			return &exitError{ExitFailure, errors.New("can't record the run: " + err.Error())}
+		}
+	}
+	if opts.replayed != "" {
+		checkReplayed(runFile, opts.replayed)
+	}
+	if opts.Daemon {
+		return Daemonize(runFile, args, opts)
+	}
+	if opts.ChildMode() {
+		status, err := RunChild(runFile, args, opts)
+		if err != nil {
+			return err
+		}
+		return &exitError{status, nil}
+	}
+	path, argv := runFile, args
+	if opts.Sudo {
+		var err error
+		if path, argv, err = sudoCommand(runFile, args); err != nil {
+			return &exitError{ExitFailure, err}
+		}
+	} else if opts.ExecWrapper != "" {
+		wrapper := strings.Fields(opts.ExecWrapper)
+		var err error
+		if path, err = exec.LookPath(wrapper[0]); err != nil {
+			return &exitError{ExitFailure, err}
+		}
+		argv = append(append(wrapper, runFile), args[1:]...)
+	}
+	if !canExec {
+		// The console sends Ctrl-C to the script too, which gorun waits
+		// for.
+		status, err := RunChild(path, argv, opts)
+		if err != nil {
+			return err
+		}
+		return &exitError{status, nil}
+	}
+	// The script keeps the pid of gorun.
+	trackRun(os.Getpid(), runFile, args, opts)
+	err := syscall.Exec(path, argv, os.Environ())
+	if err == nil {
+		panic("exec returned but succeeded")
+	}
+	untrackRun(os.Getpid())
+	return err
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
 func writeFileFromComments(content []byte, sectionName string, file string) (written bool, err error) {
 	// Write go.mod and go.sum files from inside the comments
-	section := getSection(content, sectionName)
+	section := gorun.Section(content, sectionName)
 	if len(section) > 0 {
 		err = ioutil.WriteFile(file, section, 0600)
 		if err != nil {
@@ -153,86 +529,274 @@ func writeFileFromComments(content []byte, sectionName string, file string) (wri
 	return
 }
 
-// Compile compiles and links sourcefile and atomically renames the
-// resulting binary to runfile.
-func Compile(sourcefile, runFile string, runCmdDir string) (err error) {
+// Compile compiles and links sourcefile with the additional settings in
+// build and atomically renames the resulting binary to runfile.
+func Compile(sourcefile, runFile string, runCmdDir string, build *BuildSettings) (err error) {
 	pid := strconv.Itoa(os.Getpid())
 
 	err = os.MkdirAll(runCmdDir, 0700)
 	if err != nil {
 		return err
 	}
-	var writtenSource bool
-	content, _ := ioutil.ReadFile(sourcefile)
-	if len(content) > 2 && content[0] == '#' && content[1] == '!' {
-		content[0] = '/'
-		content[1] = '/'
-		writtenSource = true
+	// Hashed before it's read, so that changes made meanwhile are
+	// caught by the next run.
+	sourceSum, err := SourceHash(sourcefile, build.Includes)
+	if err != nil {
+		return err
+	}
+	scan, err := scanScript(sourcefile)
+	if err != nil {
+		return err
 	}
+	content := scan.header
 
 	// TODO in an ideal world to protect against potential races on multiple runs, we'd
 	// include <pid> in the name, but go build wants it called go.mod, so we could put
 	// it all in its separate directory and copy over when done.
-	// Write a go.mod file from inside the comments
-	modFile := runCmdDir + "go.mod"
-	os.Remove(modFile)
-	writtenMod, err := writeFileFromComments(content, "go.mod", modFile)
+	// Write the go.mod and go.sum files from inside the comments
+	writtenMod, writtenSum, err := writeModule(content, build, runCmdDir)
 	if err != nil {
 		return
 	}
+	// The go.sum of the //gorun:require pragmas is written by go get,
+	// before go build runs.
+	writtenSum = writtenSum || len(build.Requires) > 0
+	if !writtenMod && build.AutoMod {
+		source := build.Source
+		if source == nil {
+			if source, err = ioutil.ReadFile(sourcefile); err != nil {
+				return err
+			}
+		}
+		if writtenMod, err = writeAutoModule(sourcefile, source, build, runCmdDir); err != nil {
+			return err
+		}
+		writtenSum = writtenMod
+	}
 
-	// Write a go.sum file from inside the comments
-	sumFile := runCmdDir + "go.sum"
-	os.Remove(sumFile)
-	writtenSum, err := writeFileFromComments(content, "go.sum", sumFile)
+	// Let the handlers of the other sections contribute files and env.
+	sections, err := SectionContributions(sourcefile, content, runCmdDir)
 	if err != nil {
-		return
+		return err
+	}
+	var contributed []string
+	for _, name := range sections.Files {
+		if name == filepath.Base(sourcefile) {
+			return errors.New("a section contributed " + name + ", the name of the script")
+		}
+		for _, include := range build.Includes {
+			if name == filepath.Base(include) {
+				return errors.New("a section contributed " + name + ", the name of an included file")
+			}
+		}
+		contributed = append(contributed, filepath.Join(runCmdDir, name))
+	}
+	if !build.Work {
+		defer func() {
+			for _, file := range contributed {
+				os.Remove(file)
+			}
+		}()
+	}
+
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return err
 	}
 
-	// only copy the source file to the runCmdDir if something needs to be changed about it
-	// or if it has an embedded go.mod or go.sum
 	execDir := ""
-	if writtenSource || writtenMod || writtenSum {
-		sourcefile = runFile + "." + pid + ".go"
-		err := ioutil.WriteFile(sourcefile, content, 0600)
+	sources := []string{sourcefile}
+	var overlay string
+	if writtenMod && overlaySupported(gotool, build) {
+		// build the script in place, with its go.mod and go.sum laid over
+		// its directory
+		var temps []string
+		overlay, sources, temps, err = writeOverlay(sourcefile, runFile, runCmdDir, scan, writtenSum, build.Includes, build.Source, contributed)
+		if !build.Work {
+			defer func() {
+				for _, temp := range temps {
+					os.Remove(temp)
+				}
+			}()
+		}
 		if err != nil {
 			return err
 		}
-		defer os.Remove(sourcefile)
+		execDir = filepath.Dir(sources[0])
+	} else if scan.bom || scan.shebang || scan.headerLines > 0 || build.Source != nil || writtenMod || writtenSum || len(build.Includes) > 0 || len(contributed) > 0 {
+		// only copy the source file to the runCmdDir if something needs to
+		// be changed about it (saved by a Windows editor, with a bang line,
+		// or preprocessed), or if it has an embedded go.mod or go.sum, or
+		// included or contributed files to be built along with it; the copy
+		// refers to the original with a line directive so that errors and
+		// panics point there
+		copied := runFile + "." + pid + ".go"
+		if err := writeSource(sourcefile, copied, scan, build.Source); err != nil {
+			return err
+		}
+		if !build.Work {
+			defer os.Remove(copied)
+		}
+		sources[0] = copied
 		execDir = runCmdDir
+
+		// go build wants all the files in one directory.
+		for _, include := range build.Includes {
+			copied := runFile + "." + pid + "." + filepath.Base(include)
+			if err := writeRewritten(include, copied, &scriptScan{}); err != nil {
+				return err
+			}
+			if !build.Work {
+				defer os.Remove(copied)
+			}
+			sources = append(sources, copied)
+		}
+		for _, file := range contributed {
+			if filepath.Ext(file) == ".go" {
+				sources = append(sources, file)
+			}
+		}
+	}
+
+	if build.Work {
+		fmt.Fprintln(os.Stderr, "gorun: sandbox directory: "+runCmdDir)
+		fmt.Fprintln(os.Stderr, "gorun: compiled source: "+sources[0])
+		if overlay != "" {
+			fmt.Fprintln(os.Stderr, "gorun: overlay: "+overlay)
+		}
+		fmt.Fprintln(os.Stderr, "gorun: binary: "+runFile)
 	}
 
 	// use the default environment before adding our overrides
 	var env []string
-	section := getSection(content, "go.env")
-	if len(section) > 0 {
+	if len(sections.Env) > 0 || len(build.Env) > 0 || overlay != "" {
 		env = os.Environ()
-		env = append(env, strings.Split(string(section), "\n")...)
-	}
-
-	gotool := filepath.Join(runtime.GOROOT(), "bin", "go")
-
-	if _, err := os.Stat(gotool); err != nil {
-		if gotool, err = exec.LookPath("go"); err != nil {
-			return errors.New("can't find go tool")
+		if overlay != "" {
+			// as in runCmdDir, no workspace applies
+			env = append(env, "GOWORK=off")
 		}
+		env = append(env, sections.Env...)
+		env = append(env, build.Env...)
 	}
 
 	out := runFile + "." + pid
 
-	err = Exec(execDir, env, []string{gotool, "build", "-o", out, sourcefile})
+	flags := build.Flags
+	if overlay != "" {
+		flags = append(flags[:len(flags):len(flags)], "-overlay="+overlay)
+	}
+	args := append([]string{gotool, "build", "-o", out}, flags...)
+	diagnostics := build.Diagnostics
+	if diagnostics == nil {
+		diagnostics = os.Stderr
+	}
+	// Builds starting at once are queued rather than thrashing the host.
+	release, err := acquireBuildSlot()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if len(build.Requires) > 0 {
+		if err := resolveRequires(gotool, runCmdDir, env, build.Requires, diagnostics); err != nil {
+			return err
+		}
+	}
+	if build.Vet {
+		if err := Vet(gotool, execDir, env, flags, sources, diagnostics); err != nil {
+			return err
+		}
+	}
+	var output bytes.Buffer
+	err = ExecTo(execDir, env, append(args, sources...), os.Stdout, io.MultiWriter(diagnostics, &output))
+	if err != nil {
+		if hint := missingModuleHint(sourcefile, build, output.Bytes()); hint != "" {
+			fmt.Fprintln(diagnostics, "gorun: "+hint)
+		}
+		return err
+	}
+	sum, err := FileHash(out)
+	if err != nil {
+		return err
+	}
+	meta := BuildEnvironment(gotool)
+	for key, value := range DynamicLinking(out) {
+		meta[key] = value
+	}
+	meta["sha256"] = sum
+	meta["source.sha256"] = sourceSum
+	if version, err := GoVersion(gotool); err == nil {
+		meta["goversion"] = version
+	}
+	err = WriteMeta(runFile, meta)
 	if err != nil {
 		return err
 	}
 	return os.Rename(out, runFile)
 }
 
+// ExpandGoEnv returns the variables set in a go.env section, with
+// ${env:NAME} references to the environment gorun runs in expanded, so
+// credentials such as proxy passwords don't need to be embedded in the
+// script.  Anything else, $ included, is taken literally.
+//
+// If HOME is overridden, NETRC is set to keep using the user's .netrc
+// file for authenticating to module proxies and repositories.
+func ExpandGoEnv(section []byte) []string {
+	var env []string
+	var home, netrc bool
+	for _, line := range strings.Split(string(section), "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		name := line[:i]
+		value := expandEnvRefs(line[i+1:])
+		env = append(env, name+"="+value)
+		home = home || name == "HOME"
+		netrc = netrc || name == "NETRC"
+	}
+	if home && !netrc && os.Getenv("NETRC") == "" {
+		if dir, err := os.UserHomeDir(); err == nil {
+			env = append(env, "NETRC="+filepath.Join(dir, ".netrc"))
+		}
+	}
+	return env
+}
+
+// expandEnvRefs replaces the ${env:NAME} references in value with the
+// value of the environment variable NAME.
+func expandEnvRefs(value string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(value, "${env:")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(value[i:], "}")
+		if j < 0 {
+			break
+		}
+		b.WriteString(value[:i])
+		b.WriteString(os.Getenv(value[i+len("${env:") : i+j]))
+		value = value[i+j+1:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
+
 // Exec runs args[0] with args[1:] arguments and passes through
 // stdout and stderr.
 func Exec(dir string, env []string, args []string) error {
+	return ExecTo(dir, env, args, os.Stdout, os.Stderr)
+}
+
+// ExecTo runs args[0] with args[1:] arguments, sending its output to
+// stdout and stderr.
+func ExecTo(dir string, env []string, args []string, stdout, stderr io.Writer) error {
 	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	if dir != "" {
 		cmd.Dir = dir
 	}
@@ -256,37 +820,90 @@ func Exec(dir string, env []string, args []string) error {
 // Each cached gorun binary lives under its own directory to allow separate go.mod
 // and go.sum files to be embedded and extracted from the source file.
 //
-// Note that runBaseDir contains directories for each gorun binary.
-// runFile is the full path to the cached gorun binary
+// Note that runBaseDir contains directories for each gorun binary, and
+// is specific to the platform binaries are built for.
+// runFile is the full path to the cached gorun binary, built with the
+// settings in build, identified by build.Key, or with the default ones
+// if build is nil.
 // runCmdDir is the directory inside runBaseDir where runFile lives.
-func RunFilePaths(sourcefile string) (runBaseDir, runFile string, runCmdDir string, err error) {
-	runBaseDir, err = RunBaseDir()
-	if err != nil {
-		return "", "", "", err
+func RunFilePaths(sourcefile string, build *BuildSettings) (runBaseDir, runFile string, runCmdDir string, err error) {
+	target, key, suffix := Target{runtime.GOOS, runtime.GOARCH}, []string(nil), exeSuffix
+	if build != nil {
+		key = build.Key
+		if build.Target != (Target{}) {
+			target, suffix = build.Target, build.Target.exeSuffix()
+		}
 	}
-	sourcefile, err = filepath.Abs(sourcefile)
+	runBaseDir, err = targetRunBaseDir(target)
 	if err != nil {
 		return "", "", "", err
 	}
-	sourcefile, err = filepath.EvalSymlinks(sourcefile)
+	entry, baseFileName, err := cacheEntryName(sourcefile)
 	if err != nil {
 		return "", "", "", err
 	}
-	pathElements := strings.Split(sourcefile, string(filepath.Separator))
-	baseFileName := pathElements[len(pathElements)-1]
-	runFile = strings.Replace(sourcefile, "_", "__", -1)
-	runFile = strings.Replace(runFile, string(filepath.Separator), "ROOT_", 1)
-	runFile = strings.Replace(runFile, string(filepath.Separator), "_", -1)
-	runCmdDir = filepath.Join(runBaseDir, runFile) + string(filepath.Separator)
+	runCmdDir = filepath.Join(runBaseDir, entry) + string(filepath.Separator)
 
 	runFile = runCmdDir
-	runFile += baseFileName + ".gorun"
+	runFile += baseFileName + keySuffix(key) + ".gorun" + suffix
 
 	return
 }
 
-func sysStat(stat os.FileInfo) *syscall.Stat_t {
-	return stat.Sys().(*syscall.Stat_t)
+// cacheEntryName returns the name of the cache directory holding the
+// binaries built from sourcefile, and the base name of the latter.
+//
+// The name is the absolute path of the script escaped by entryName, so
+// distinct scripts never share an entry.
+func cacheEntryName(sourcefile string) (entry, baseFileName string, err error) {
+	sourcefile, err = filepath.Abs(sourcefile)
+	if err != nil {
+		return "", "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(sourcefile); err == nil {
+		sourcefile = resolved
+	} else if !os.IsNotExist(err) {
+		// A script that's gone may still have a cache entry to remove.
+		return "", "", err
+	}
+	pathElements := strings.Split(sourcefile, string(filepath.Separator))
+	baseFileName = pathElements[len(pathElements)-1]
+	return entryName(sourcefile, filepath.Separator), baseFileName, nil
+}
+
+// entryName returns the cache entry name of the absolute path, whose
+// elements are separated by separator: the path with % escaped as %25,
+// the separators as %2F and colons, which Windows doesn't allow in file
+// names but has after drive letters, as %3A.  Too long to be a file
+// name, it's made of an h, the hash of the path and the end of the
+// escaped path.
+func entryName(path string, separator rune) string {
+	entry := strings.Replace(path, "%", "%25", -1)
+	entry = strings.Replace(entry, string(separator), "%2F", -1)
+	entry = strings.Replace(entry, ":", "%3A", -1)
+	if len(entry) > maxEntryName {
+		sum := sha256.Sum256([]byte(path))
+		hash := "h" + hex.EncodeToString(sum[:16]) + "-"
+		entry = hash + entry[len(entry)-(maxEntryName-len(hash)):]
+	}
+	return entry
+}
+
+// maxEntryName is the length of the longest cache entry name, file
+// systems commonly limiting file names to 255 bytes.
+const maxEntryName = 200
+
+// isLegacyEntry reports whether name is a cache entry named by older
+// versions of gorun, which mangled paths in a way that could give
+// distinct scripts the same entry, or left colons unescaped, or one of
+// the auxiliary directories they kept next to the entries.  These are
+// never used and get removed when the cache is cleaned.
+func isLegacyEntry(name string) bool {
+	switch name {
+	case "markdown", "piped", "compressed", "remote", "objects", "gomod", "bundles":
+		return true
+	}
+	return strings.HasPrefix(name, "ROOT_") || strings.Contains(name, ":")
 }
 
 func canWrite(stat os.FileInfo, euid, egid int) bool {
@@ -295,9 +912,104 @@ func canWrite(stat os.FileInfo, euid, egid int) bool {
 	return perm&02 != 0 || perm&020 != 0 && uint32(egid) == sstat.Gid || perm&0200 != 0 && uint32(euid) == sstat.Uid
 }
 
+// SafeSourceRequired reports whether scripts must pass CheckSafeSource
+// before being compiled and run.  It's controlled by GORUN_SAFE_SOURCE
+// and defaults to on when running as root.
+func SafeSourceRequired() (bool, error) {
+	value := os.Getenv("GORUN_SAFE_SOURCE")
+	if value == "" {
+		return os.Geteuid() == 0, nil
+	}
+	safe, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid GORUN_SAFE_SOURCE: " + value)
+	}
+	return safe, nil
+}
+
+// CheckSafeSource returns an error if someone other than the current
+// user could change what sourcefile contains: the file is world-writable
+// or owned by another user, its directory is owned by someone else than
+// the user or root, or is group or world-writable, letting others
+// replace the file, or any directory above it is world-writable without
+// the sticky bit set.
+func CheckSafeSource(sourcefile string) error {
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	euid := os.Geteuid()
+	if stat.Mode().Perm()&02 != 0 {
+		return errors.New("unsafe script, world-writable: " + path)
+	}
+	if sysStat(stat).Uid != uint32(euid) {
+		return errors.New("unsafe script, owned by uid " + strconv.Itoa(int(sysStat(stat).Uid)) + ": " + path)
+	}
+	dir := filepath.Dir(path)
+	stat, err = os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if stat.Mode().Perm()&02 != 0 {
+		return errors.New("unsafe script, in world-writable directory: " + dir)
+	}
+	if stat.Mode().Perm()&020 != 0 {
+		return errors.New("unsafe script, in group-writable directory: " + dir)
+	}
+	if uid := sysStat(stat).Uid; uid != uint32(euid) && uid != 0 {
+		return errors.New("unsafe script, in directory owned by uid " + strconv.Itoa(int(uid)) + ": " + dir)
+	}
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+		stat, err = os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if stat.Mode().Perm()&02 != 0 && stat.Mode()&os.ModeSticky == 0 {
+			return errors.New("unsafe script, in world-writable directory: " + dir)
+		}
+	}
+}
+
 // RunDir returns the directory where binary files generates should be put.
 // In case a safe directory isn't found, one will be created.
 func RunBaseDir() (rundir string, err error) {
+	return targetRunBaseDir(Target{runtime.GOOS, runtime.GOARCH})
+}
+
+// targetRunBaseDir returns the directory where the binaries built for
+// target are put, as RunBaseDir does for the host.
+func targetRunBaseDir(target Target) (rundir string, err error) {
+	suffix := target.GOOS + "_" + target.GOARCH
+	// Environments have caches of their own.
+	env, err := ActiveEnv()
+	if err != nil {
+		return "", err
+	}
+	if env != "" {
+		suffix += "-" + env
+	}
+	if runtime.GOOS == "windows" {
+		// The cache directory of the user is theirs alone.
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		rundir = filepath.Join(cacheDir, "gorun", suffix)
+		return rundir, os.MkdirAll(rundir, 0700)
+	}
 	tempdir := os.TempDir()
 	euid := os.Geteuid()
 	stat, err := os.Stat(tempdir)
@@ -309,7 +1021,6 @@ func RunBaseDir() (rundir string, err error) {
 		return "", errors.New("can't get hostname: " + err.Error())
 	}
 	prefix := "gorun-" + hostname + "-" + strconv.Itoa(euid)
-	suffix := runtime.GOOS + "_" + runtime.GOARCH
 	prefixi := prefix
 	var i uint64
 	for {
@@ -335,17 +1046,49 @@ func RunBaseDir() (rundir string, err error) {
 
 const CleanFileDelay = time.Hour * 24 * 7
 
+// cleanWorkers is how many cache entries CleanDir checks at once.
+const cleanWorkers = 8
+
+// CleanDue reports whether the cache in runBaseDir is due for cleaning,
+// which is done at most once every CleanFileDelay.
+func CleanDue(runBaseDir string, now time.Time) bool {
+	info, err := os.Stat(filepath.Join(runBaseDir, "last-cleaned"))
+	return err != nil || !info.ModTime().After(now.Add(-CleanFileDelay))
+}
+
+// StartCleaning cleans the cache in a detached gorun gc --auto process.
+func StartCleaning() {
+	gorun, err := os.Executable()
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(gorun, "gc", "--auto")
+	cmd.SysProcAttr = detached()
+	if cmd.Start() == nil {
+		cmd.Process.Release()
+	}
+}
+
 // CleanDir removes binary files under rundir in case they were not
-// accessed for more than CleanFileDelay nanoseconds.  A last-cleaned
-// marker file is created so that the next verification is only done
-// after CleanFileDelay nanoseconds.
+// accessed for more than CleanFileDelay nanoseconds, and likewise the
+// auxiliary files next to them.  A last-cleaned marker file is created
+// so that the next verification is only done after CleanFileDelay
+// nanoseconds.  Nothing is done while another process is cleaning.
 func CleanDir(runBaseDir string, now time.Time) error {
-	cleanedfile := filepath.Join(runBaseDir, "last-cleaned")
-	cleanLine := now.Add(-CleanFileDelay)
-	if info, err := os.Stat(cleanedfile); err == nil && info.ModTime().After(cleanLine) {
+	lock, err := os.OpenFile(filepath.Join(runBaseDir, "last-cleaned.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if locked, err := lockFile(lock, false); !locked {
+		return err
+	}
+	if !CleanDue(runBaseDir, now) {
 		// It's been cleaned recently.
 		return nil
 	}
+	cleanLine := now.Add(-CleanFileDelay)
+	cleanedfile := filepath.Join(runBaseDir, "last-cleaned")
 	f, err := os.Create(cleanedfile)
 	if err != nil {
 		return err
@@ -356,20 +1099,53 @@ func CleanDir(runBaseDir string, now time.Time) error {
 		return err
 	}
 
-	// Look for expired files.
+	// Look for expired files.  Entries are checked and removed by a few
+	// workers, as there may be many, and may be removed meanwhile by
+	// another process.
 	d, err := os.Open(runBaseDir)
 	if err != nil {
 		return err
 	}
-	infos, err := d.Readdir(-1)
+	names, err := d.Readdirnames(-1)
+	d.Close()
 	if err != nil {
 		return err
 	}
-	for _, info := range infos {
-		atim := atime(info)
-		access := time.Unix(int64(atim.Sec), int64(atim.Nsec))
-		if access.Before(cleanLine) {
-			os.RemoveAll(filepath.Join(runBaseDir, info.Name()))
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < cleanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				path := filepath.Join(runBaseDir, name)
+				info, err := os.Lstat(path)
+				if err != nil {
+					continue
+				}
+				atim := atime(info)
+				access := time.Unix(int64(atim.Sec), int64(atim.Nsec))
+				if !access.Before(cleanLine) && !isLegacyEntry(name) {
+					continue
+				}
+				if info.IsDir() {
+					removeEntry(path)
+				} else {
+					os.Remove(path)
+				}
+			}
+		}()
+	}
+	for _, name := range names {
+		if name != "last-cleaned" && name != "last-cleaned.lock" && name != auxDirName {
+			work <- name
+		}
+	}
+	close(work)
+	wg.Wait()
+	for _, entry := range auxEntries(runBaseDir) {
+		if entry.access.Before(cleanLine) {
+			os.RemoveAll(filepath.Join(runBaseDir, entry.name))
 		}
 	}
 	return nil
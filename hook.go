@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hookMarker identifies the git hooks installed by gorun.
+const hookMarker = "# installed by gorun hook install"
+
+// InstallHook installs the git hook called name of the repository in
+// the current directory as a shim running the script sourcefile through
+// gorun, so that it's only rebuilt when it changed.  The script is found
+// relative to the top of the work tree, so it must be in it.  A hook that
+// wasn't installed by gorun is only replaced if force is set.  It
+// returns the path of the hook.
+func InstallHook(name, sourcefile string, force bool) (string, error) {
+	if name == "" || strings.ContainsRune(name, filepath.Separator) {
+		return "", errors.New("invalid hook name: " + name)
+	}
+	top, err := gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+	hooks, err := gitOutput("rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(top); err == nil {
+		top = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	rel, err := filepath.Rel(top, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", errors.New(sourcefile + " isn't in the work tree of " + top)
+	}
+	gorun, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	hook := filepath.Join(hooks, name)
+	if old, err := ioutil.ReadFile(hook); err == nil && !bytes.Contains(old, []byte(hookMarker)) && !force {
+		return "", errors.New(hook + " exists, use --force to replace it")
+	}
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		return "", err
+	}
+	shim := "#!/bin/sh\n" + hookMarker + "\n" +
+		"exec " + shellQuote(gorun) + " \"$(git rev-parse --show-toplevel)\"/" + shellQuote(filepath.ToSlash(rel)) + " \"$@\"\n"
+	tmp := hook + ".gorun"
+	if err := ioutil.WriteFile(tmp, []byte(shim), 0755); err != nil {
+		return "", err
+	}
+	return hook, os.Rename(tmp, hook)
+}
+
+// gitOutput runs git with args in the current directory and returns its
+// output, trimmed.
+func gitOutput(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("git " + strings.Join(args, " ") + " failed: " + strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// ScriptInfo describes what gorun makes of a script and the state of
+// its binary in the cache.
+type ScriptInfo struct {
+	Script   string     `json:"script"`
+	Shebang  string     `json:"shebang,omitempty"`
+	Sections []string   `json:"sections"`
+	Pragmas  []Pragma   `json:"pragmas"`
+	CacheDir string     `json:"cache_dir"`
+	Binary   string     `json:"binary"`
+	System   string     `json:"system_binary,omitempty"`
+	State    string     `json:"state"`
+	Size     int64      `json:"size,omitempty"`
+	Built    *time.Time `json:"built,omitempty"`
+}
+
+// Inspect returns what gorun would do with sourcefile when run with opts.
+func Inspect(opts *Options, sourcefile string) (*ScriptInfo, error) {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return nil, &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return nil, err
+	}
+	_, runFile, runCmdDir, err := RunFilePaths(sourcefile, build)
+	if err != nil {
+		return nil, err
+	}
+	info := &ScriptInfo{
+		Script:   sourcefile,
+		Sections: sectionNames(content),
+		Pragmas:  Pragmas(content),
+		CacheDir: runCmdDir,
+		Binary:   runFile,
+	}
+	content = bytes.TrimPrefix(content, utf8BOM)
+	if line := strings.TrimRight(string(content[:lineEnd(content)]), "\r"); strings.HasPrefix(line, "#!") || strings.HasPrefix(line, "///") {
+		info.Shebang = line
+	}
+	if info.Sections == nil {
+		info.Sections = []string{}
+	}
+	if info.Pragmas == nil {
+		info.Pragmas = []Pragma{}
+	}
+
+	if hasPragma(info.Pragmas, "preprocess") || opts.Template {
+		// Its binary depends on the output of commands, which info
+		// doesn't run.
+		info.Binary = ""
+		info.State = "unknown: built from the preprocessed script"
+		return info, nil
+	}
+	info.State, err = binaryState(sourcefile, build.Includes, runFile)
+	if err != nil {
+		return nil, err
+	}
+	verify, err := VerifyMode()
+	if err != nil {
+		return nil, err
+	}
+	if sum, err := SourceHash(sourcefile, build.Includes); err == nil {
+		info.System = SystemBinary(sourcefile, build.Key, sum, verify)
+	}
+	if rstat, err := os.Stat(runFile); err == nil {
+		info.Size = rstat.Size()
+	}
+	// The binary has the modification time of the source it was built
+	// from, but the metadata is written when it's built.
+	if mstat, err := os.Stat(MetaFile(runFile)); err == nil {
+		built := mstat.ModTime()
+		info.Built = &built
+	}
+	return info, nil
+}
+
+// binaryState tells whether runFile can be run as built from sourcefile
+// and includes, and if not why it would be rebuilt.
+func binaryState(sourcefile string, includes []string, runFile string) (string, error) {
+	modTime, err := newestModTime(sourcefile, includes)
+	if err != nil {
+		return "", err
+	}
+	sum, err := SourceHash(sourcefile, includes)
+	if err != nil {
+		return "", err
+	}
+	rstat, err := os.Stat(runFile)
+	switch {
+	case err != nil:
+		return "not built", nil
+	case rstat.Mode().Perm()&0700 != 0700 || !UpToDate(runFile, rstat, sum, modTime):
+		return "stale: source changed", nil
+	}
+	meta, err := ReadMeta(runFile)
+	if err != nil {
+		return "fresh", nil
+	}
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case !meta.SameBuildEnvironment(BuildEnvironment(gotool)):
+		return "stale: build environment changed", nil
+	case meta.DynamicLinkingChanged():
+		return "stale: system linker changed", nil
+	}
+	return "fresh", nil
+}
+
+// sectionNames returns the names of the embedded sections of a script.
+func sectionNames(content []byte) []string {
+	var names []string
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		name, ok := sectionStart(line)
+		if !ok {
+			continue
+		}
+		for _, next := range lines[i+1:] {
+			if strings.TrimSpace(next) == "// <<< "+name {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// lineEnd returns the length of the first line of content.
+func lineEnd(content []byte) int {
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		return i
+	}
+	return len(content)
+}
+
+// Print writes info to w, as JSON if asJSON is set.
+func (info *ScriptInfo) Print(w io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "script:\t%s\n", info.Script)
+	if info.Shebang != "" {
+		fmt.Fprintf(tw, "shebang:\t%s\n", info.Shebang)
+	}
+	fmt.Fprintf(tw, "sections:\t%s\n", strings.Join(info.Sections, ", "))
+	for _, pragma := range info.Pragmas {
+		fmt.Fprintf(tw, "pragma:\t%s\n", strings.TrimSpace(pragma.Name+" "+strings.Join(pragma.Args, " ")))
+	}
+	fmt.Fprintf(tw, "cache directory:\t%s\n", info.CacheDir)
+	if info.Binary != "" {
+		fmt.Fprintf(tw, "binary:\t%s\n", info.Binary)
+	}
+	fmt.Fprintf(tw, "state:\t%s\n", info.State)
+	if info.System != "" {
+		fmt.Fprintf(tw, "system binary:\t%s\n", info.System)
+	}
+	if info.Size > 0 {
+		fmt.Fprintf(tw, "size:\t%s\n", formatSize(info.Size))
+	}
+	if info.Built != nil {
+		fmt.Fprintf(tw, "built:\t%s\n", info.Built.Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Syslog priorities used when logging script output and events.
+const (
+	PriorityErr    = 3
+	PriorityNotice = 5
+	PriorityInfo   = 6
+)
+
+// Logger sends lines to a system logging backend.
+type Logger interface {
+	Log(priority int, line string) error
+	Close() error
+}
+
+// NewLogger returns a Logger for the given driver, journald or syslog,
+// logging under the given identifier.
+func NewLogger(driver, ident string) (Logger, error) {
+	switch driver {
+	case "journald":
+		return newJournalLogger(ident)
+	case "syslog":
+		return newSyslogLogger(ident)
+	}
+	return nil, errors.New("unknown log driver: " + driver)
+}
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalLogger writes to journald using its native protocol, so
+// entries carry their priority, identifier and gorun's own fields.
+type journalLogger struct {
+	conn  *net.UnixConn
+	ident string
+}
+
+func newJournalLogger(ident string) (Logger, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.New("can't connect to journald: " + err.Error())
+	}
+	return &journalLogger{conn, ident}, nil
+}
+
+func (l *journalLogger) Log(priority int, line string) error {
+	var b strings.Builder
+	b.WriteString("PRIORITY=" + strconv.Itoa(priority) + "\n")
+	b.WriteString("SYSLOG_IDENTIFIER=" + l.ident + "\n")
+	b.WriteString("SYSLOG_PID=" + strconv.Itoa(os.Getpid()) + "\n")
+	b.WriteString("MESSAGE=" + line + "\n")
+	_, err := l.conn.Write([]byte(b.String()))
+	return err
+}
+
+func (l *journalLogger) Close() error {
+	return l.conn.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// LSP runs gopls for sourcefile, speaking the language server protocol
+// on stdin and stdout.  The script is materialized with its go.mod and
+// go.sum sections into a module workspace in the cache, where gopls is
+// run, and the messages exchanged with the editor are rewritten so that
+// the latter only ever sees the original file.
+func LSP(opts *Options, sourcefile string) error {
+	gopls, err := exec.LookPath("gopls")
+	if err != nil {
+		return errors.New("can't find gopls, install it with: go install golang.org/x/tools/gopls@latest")
+	}
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return err
+	}
+	_, _, runCmdDir, err := RunFilePaths(sourcefile, build)
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return err
+	}
+	workspace := filepath.Join(runCmdDir, "lsp")
+	workFile := filepath.Join(workspace, strings.TrimSuffix(filepath.Base(path), ".go")+".go")
+	if err := materializeWorkspace(content, workspace, workFile); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(gopls, "serve")
+	cmd.Dir = workspace
+	cmd.Stderr = os.Stderr
+	if section := gorun.Section(content, "go.env"); len(section) > 0 || len(build.Env) > 0 {
+		cmd.Env = append(append(os.Environ(), ExpandGoEnv(section)...), build.Env...)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	origURI := []byte(fileURI(path))
+	workURI := []byte(fileURI(workFile))
+	go func() {
+		defer stdin.Close()
+		proxyLSP(os.Stdin, stdin, func(msg []byte) []byte {
+			if bytes.Contains(msg, []byte(`"textDocument/didSave"`)) && bytes.Contains(msg, origURI) {
+				// Closed files are read from disk, so keep up.
+				if content, err := ioutil.ReadFile(path); err == nil {
+					materializeWorkspace(content, workspace, workFile)
+				}
+			}
+			msg = bytes.Replace(msg, origURI, workURI, -1)
+			// gopls sees the bang line as a comment, as the compiler does.
+			return bytes.Replace(msg, []byte(`"text":"#!`), []byte(`"text":"//`), -1)
+		})
+	}()
+	proxyLSP(stdout, os.Stdout, func(msg []byte) []byte {
+		return bytes.Replace(msg, workURI, origURI, -1)
+	})
+	return cmd.Wait()
+}
+
+// materializeWorkspace writes the module workspace of a script with
+// content into workspace, the script itself being copied to workFile.
+func materializeWorkspace(content []byte, workspace, workFile string) error {
+	if err := os.MkdirAll(workspace, 0700); err != nil {
+		return err
+	}
+	content = bytes.TrimPrefix(content, utf8BOM)
+	modFile := filepath.Join(workspace, "go.mod")
+	written, err := writeFileFromComments(content, "go.mod", modFile)
+	if err != nil {
+		return err
+	}
+	if !written {
+		// Standard library only, but gopls wants a module.
+		if err := ioutil.WriteFile(modFile, []byte("module script\n"), 0600); err != nil {
+			return err
+		}
+	}
+	sumFile := filepath.Join(workspace, "go.sum")
+	os.Remove(sumFile)
+	if _, err := writeFileFromComments(content, "go.sum", sumFile); err != nil {
+		return err
+	}
+	if bytes.HasPrefix(content, []byte("#!")) {
+		content = append([]byte("//"), content[2:]...)
+	}
+	return ioutil.WriteFile(workFile, content, 0600)
+}
+
+// fileURI returns the file URI of path as found in LSP messages.
+func fileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// proxyLSP copies the LSP messages read from r to w, passing each of
+// their contents through rewrite.
+func proxyLSP(r io.Reader, w io.Writer, rewrite func([]byte) []byte) error {
+	br := bufio.NewReader(r)
+	for {
+		length := -1
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				break
+			}
+			if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(line[:i], "Content-Length") {
+				if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil {
+					return errors.New("bad LSP header: " + line)
+				}
+			}
+		}
+		if length < 0 {
+			return errors.New("LSP message without Content-Length")
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return err
+		}
+		msg = rewrite(msg)
+		if _, err := io.WriteString(w, "Content-Length: "+strconv.Itoa(len(msg))+"\r\n\r\n"); err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// ManifestName is the name of the file cataloguing a team's scripts.
+// It's a small YAML document such as:
+//
+//	scripts:
+//	  backup:
+//	    description: Back up the production database
+//	    entry: tools/backup.go
+//	    go: "1.21"
+//
+// Entry points are relative to the directory holding the manifest.
+const ManifestName = "scripts.gorun.yaml"
+
+// ManifestScript is a script listed in a manifest.
+type ManifestScript struct {
+	Name        string
+	Description string
+	Entry       string
+	Go          string
+}
+
+// FindManifest looks for a manifest in dir and its parents.
+func FindManifest(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, ManifestName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("can't find " + ManifestName)
+		}
+		dir = parent
+	}
+}
+
+// ReadManifest reads the scripts listed in the manifest at path, with
+// their entry points made absolute.  Only the subset of YAML needed by
+// the manifest format is understood.
+func ReadManifest(path string) ([]ManifestScript, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scripts []ManifestScript
+	var inScripts bool
+	var scriptIndent int
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		i := strings.Index(trimmed, ":")
+		if i < 0 {
+			return nil, errors.New(path + ":" + strconv.Itoa(n) + ": expected key: value")
+		}
+		key := unquote(strings.TrimSpace(trimmed[:i]))
+		value := unquote(strings.TrimSpace(trimmed[i+1:]))
+		switch {
+		case indent == 0:
+			inScripts = key == "scripts"
+			scriptIndent = 0
+		case !inScripts:
+		case scriptIndent == 0 || indent == scriptIndent:
+			scriptIndent = indent
+			scripts = append(scripts, ManifestScript{Name: key})
+		case indent > scriptIndent:
+			script := &scripts[len(scripts)-1]
+			switch key {
+			case "description":
+				script.Description = value
+			case "entry":
+				script.Entry = value
+			case "go":
+				script.Go = value
+			}
+		default:
+			return nil, errors.New(path + ":" + strconv.Itoa(n) + ": bad indentation")
+		}
+	}
+	dir := filepath.Dir(path)
+	for i := range scripts {
+		if scripts[i].Entry == "" {
+			return nil, errors.New(path + ": script " + scripts[i].Name + " has no entry")
+		}
+		if !filepath.IsAbs(scripts[i].Entry) {
+			scripts[i].Entry = filepath.Join(dir, filepath.FromSlash(scripts[i].Entry))
+		}
+	}
+	return scripts, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// GoVersion returns the version of the given go tool, such as "1.21.3".
+func GoVersion(gotool string) (string, error) {
+	out, err := exec.Command(gotool, "version").Output()
+	if err != nil {
+		return "", errors.New("failed to run go version: " + err.Error())
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "go") {
+		return "", errors.New("unexpected go version output: " + strings.TrimSpace(string(out)))
+	}
+	return strings.TrimPrefix(fields[2], "go"), nil
+}
+
+// versionAtLeast reports whether the dotted version have is at least
+// want, ignoring any pre-release suffix such as "rc1".
+func versionAtLeast(have, want string) bool {
+	hs := strings.Split(have, ".")
+	ws := strings.Split(want, ".")
+	for i := 0; i < len(ws); i++ {
+		var h int
+		if i < len(hs) {
+			h = leadingInt(hs[i])
+		}
+		w := leadingInt(ws[i])
+		if h != w {
+			return h > w
+		}
+	}
+	return true
+}
+
+func leadingInt(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n
+}
+
+// ManifestLookup finds the script called name in the manifest for the
+// current directory, checking the go tool satisfies its Go version.
+func ManifestLookup(name string) (ManifestScript, error) {
+	path, err := FindManifest(".")
+	if err != nil {
+		return ManifestScript{}, err
+	}
+	scripts, err := ReadManifest(path)
+	if err != nil {
+		return ManifestScript{}, err
+	}
+	for _, script := range scripts {
+		if script.Name != name {
+			continue
+		}
+		if script.Go != "" {
+			gotool, err := gorun.GoTool()
+			if err != nil {
+				return script, err
+			}
+			version, err := GoVersion(gotool)
+			if err != nil {
+				return script, err
+			}
+			if !versionAtLeast(version, script.Go) {
+				return script, errors.New("script " + name + " requires go " + script.Go + ", have go" + version)
+			}
+		}
+		return script, nil
+	}
+	return ManifestScript{}, errors.New("no script named " + name + " in " + path)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorun-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	abs := filepath.Join(dir, "abs.go")
+	tests := []struct {
+		content string
+		scripts []ManifestScript
+		ok      bool
+	}{
+		{"", nil, true},
+		{"---\n# scripts\nscripts:\n  backup:\n    description: Back up the database # nightly\n    entry: tools/backup.go\n    go: \"1.21\"\n",
+			[]ManifestScript{{"backup", "Back up the database", filepath.Join(dir, "tools", "backup.go"), "1.21"}}, true},
+		{"scripts:\n    a:\n        entry: 'a.go'\n    b:\n        entry: " + abs + "\n        unknown: x\n",
+			[]ManifestScript{{"a", "", filepath.Join(dir, "a.go"), ""}, {"b", "", abs, ""}}, true},
+		{"other:\n  a:\n    entry: a.go\nscripts:\n  b:\n    entry: b.go\n",
+			[]ManifestScript{{"b", "", filepath.Join(dir, "b.go"), ""}}, true},
+		{"scripts:\n  a:\n    description: no entry\n", nil, false},
+		{"scripts:\n  a\n", nil, false},
+		{"scripts:\n    a:\n      entry: a.go\n  b:\n", nil, false},
+	}
+	path := filepath.Join(dir, ManifestName)
+	for _, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		scripts, err := ReadManifest(path)
+		if (err == nil) != test.ok || !reflect.DeepEqual(scripts, test.scripts) {
+			t.Errorf("ReadManifest(%q) = %+v, %v", test.content, scripts, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsMarkdown reports whether sourcefile is a Markdown document whose Go
+// code blocks should be run, rather than Go source.
+func IsMarkdown(sourcefile string) bool {
+	ext := strings.ToLower(filepath.Ext(sourcefile))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// markdownBlock is a fenced Go code block of a Markdown document.  Its
+// name is the word following the language in the info string, as in
+// "```go setup".
+type markdownBlock struct {
+	name string
+	code string
+}
+
+func markdownBlocks(content []byte) []markdownBlock {
+	var blocks []markdownBlock
+	var inBlock, isGo bool
+	var block markdownBlock
+	var fence string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if inBlock {
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				if isGo {
+					blocks = append(blocks, block)
+				}
+				inBlock = false
+			} else {
+				block.code += line + "\n"
+			}
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "```") && !strings.HasPrefix(trimmed, "~~~") {
+			continue
+		}
+		fence = trimmed[:3]
+		for len(fence) < len(trimmed) && trimmed[len(fence)] == fence[0] {
+			fence += fence[:1]
+		}
+		info := strings.Fields(trimmed[len(fence):])
+		inBlock = true
+		isGo = len(info) > 0 && (info[0] == "go" || info[0] == "golang")
+		block = markdownBlock{}
+		if len(info) > 1 {
+			block.name = info[1]
+		}
+	}
+	return blocks
+}
+
+// MarkdownSource returns the Go program made of the fenced Go code
+// blocks of a Markdown document.  If name is empty, the unnamed blocks
+// are stitched together in order, only the first one keeping its
+// package clause; otherwise the block with that name is returned.
+func MarkdownSource(content []byte, name string) ([]byte, error) {
+	blocks := markdownBlocks(content)
+	if len(blocks) == 0 {
+		return nil, errors.New("no Go code blocks found")
+	}
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		if name != "" {
+			if block.name == name {
+				return []byte(block.code), nil
+			}
+			continue
+		}
+		if block.name != "" {
+			continue
+		}
+		code := block.code
+		if buf.Len() > 0 {
+			lines := strings.Split(code, "\n")
+			for i, line := range lines {
+				if strings.HasPrefix(strings.TrimSpace(line), "package ") {
+					// Keep the line numbering.
+					lines[i] = ""
+				}
+			}
+			code = strings.Join(lines, "\n")
+		}
+		buf.WriteString(code)
+	}
+	if name != "" {
+		return nil, errors.New("no Go code block named " + name)
+	}
+	if buf.Len() == 0 {
+		return nil, errors.New("no unnamed Go code blocks found")
+	}
+	return buf.Bytes(), nil
+}
+
+// RunMarkdown runs the Go code blocks of the Markdown document args[0],
+// the unnamed ones or the one called block, with arguments args[1:].  The
+// program is extracted into the cache and run as any other script.
+func RunMarkdown(opts *Options, block string, args []string) error {
+	content, err := ioutil.ReadFile(args[0])
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	safe, err := SafeSourceRequired()
+	if err != nil {
+		return err
+	}
+	if safe {
+		if err := CheckSafeSource(args[0]); err != nil {
+			return err
+		}
+	}
+	// The program run is extracted, so check the document.
+	if opts.VerifyManifest {
+		if err := VerifyContent(args[0], content); err != nil {
+			return err
+		}
+		verified := *opts
+		verified.VerifyManifest = false
+		opts = &verified
+	}
+	source, err := MarkdownSource(content, block)
+	if err != nil {
+		return errors.New(args[0] + ": " + err.Error())
+	}
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(path + "\x00" + block))
+	sourcefile, err := materialize(auxDir(runBaseDir, "markdown"), hex.EncodeToString(sum[:8])+".go", source)
+	if err != nil {
+		return err
+	}
+	return Run(opts, append([]string{sourcefile}, args[1:]...))
+}
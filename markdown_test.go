@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarkdownBlocks(t *testing.T) {
+	tests := []struct {
+		content string
+		blocks  []markdownBlock
+	}{
+		{"# Title\n\nNo code.\n", nil},
+		{"```go\npackage main\n```\n", []markdownBlock{{"", "package main\n"}}},
+		{"```golang setup\nx := 1\n```\n", []markdownBlock{{"setup", "x := 1\n"}}},
+		{"```sh\nls\n```\n```go\na\n```\n", []markdownBlock{{"", "a\n"}}},
+		{"~~~go\na\n~~~\n", []markdownBlock{{"", "a\n"}}},
+		// A longer fence holds shorter ones, and the other kind.
+		{"````go\n```\n~~~\n````\n", []markdownBlock{{"", "```\n~~~\n"}}},
+		{"```go\n  indented\n\n```\n", []markdownBlock{{"", "  indented\n\n"}}},
+		{"  ```go\na\n  ```\n", []markdownBlock{{"", "a\n"}}},
+		// Unterminated blocks are dropped.
+		{"```go\na\n", nil},
+		{"```go\na\n```\ntext\n```go b\nc\n```\n", []markdownBlock{{"", "a\n"}, {"b", "c\n"}}},
+	}
+	for _, test := range tests {
+		if blocks := markdownBlocks([]byte(test.content)); !reflect.DeepEqual(blocks, test.blocks) {
+			t.Errorf("markdownBlocks(%q) = %q, want %q", test.content, blocks, test.blocks)
+		}
+	}
+}
+
+func TestMarkdownSource(t *testing.T) {
+	content := "```go\npackage main\n```\n```go helper\npackage main\nfunc h() {}\n```\n```go\npackage main\nfunc main() {}\n```\n"
+	tests := []struct {
+		name, source string
+		ok           bool
+	}{
+		{"", "package main\n\nfunc main() {}\n", true},
+		{"helper", "package main\nfunc h() {}\n", true},
+		{"missing", "", false},
+	}
+	for _, test := range tests {
+		source, err := MarkdownSource([]byte(content), test.name)
+		if (err == nil) != test.ok || string(source) != test.source {
+			t.Errorf("MarkdownSource(%q) = %q, %v", test.name, source, err)
+		}
+	}
+	if _, err := MarkdownSource([]byte("text\n"), ""); err == nil {
+		t.Error("no error without code blocks")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Meta holds what gorun records about a compiled binary.  It's stored
+// next to the binary in a file with one key=value pair per line.
+type Meta map[string]string
+
+// MetaFile returns the path of the metadata file for runFile.
+func MetaFile(runFile string) string {
+	return runFile + ".meta"
+}
+
+// ReadMeta reads the metadata recorded for runFile.
+func ReadMeta(runFile string) (Meta, error) {
+	data, err := ioutil.ReadFile(MetaFile(runFile))
+	if err != nil {
+		return nil, err
+	}
+	meta := make(Meta)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "="); i > 0 {
+			meta[line[:i]] = line[i+1:]
+		}
+	}
+	return meta, nil
+}
+
+// WriteMeta atomically records meta as the metadata for runFile.
+func WriteMeta(runFile string, meta Meta) error {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(key + "=" + meta[key] + "\n")
+	}
+	tmp := MetaFile(runFile) + "." + strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, MetaFile(runFile))
+}
+
+// buildEnvVars are the environment variables affecting the binaries
+// built by the go tool.
+var buildEnvVars = []string{
+	"CC", "CXX", "CGO_ENABLED", "CGO_CFLAGS", "CGO_CPPFLAGS", "CGO_CXXFLAGS",
+	"CGO_FFLAGS", "CGO_LDFLAGS", "GO111MODULE", "GOARCH", "GOEXPERIMENT",
+	"GOFLAGS", "GOOS", "GOROOT", "GOTOOLCHAIN", "GOWORK", "GO386", "GOAMD64",
+	"GOARM", "GOARM64", "GOMIPS", "GOMIPS64", "GOPPC64", "GORISCV64", "GOWASM",
+}
+
+// BuildEnvironment returns metadata describing the build environment
+// binaries are built in by gotool: the relevant environment variables,
+// as env.NAME entries, and the identity of the toolchain.
+func BuildEnvironment(gotool string) Meta {
+	meta := Meta{}
+	for _, name := range buildEnvVars {
+		if value := os.Getenv(name); value != "" {
+			meta["env."+name] = strings.Replace(value, "\n", " ", -1)
+		}
+	}
+	if id := fileIdentity(gotool); id != "" {
+		meta["toolchain"] = gotool + " " + id
+	}
+	return meta
+}
+
+// SameBuildEnvironment reports whether meta was recorded for a binary
+// built in the build environment env.
+func (meta Meta) SameBuildEnvironment(env Meta) bool {
+	for key, value := range meta {
+		if strings.HasPrefix(key, "env.") && env[key] != value {
+			return false
+		}
+	}
+	for key, value := range env {
+		if meta[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// FileHash returns the hex encoded SHA-256 digest of the file at path.
+func FileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SourceHash returns the hex encoded SHA-256 digest of the contents of
+// sourcefile, go.mod, go.sum and go.env sections included, and of its
+// included files.  Without includes, it's the digest of sourcefile.
+func SourceHash(sourcefile string, includes []string) (string, error) {
+	sum, err := FileHash(sourcefile)
+	if err != nil || len(includes) == 0 {
+		return sum, err
+	}
+	h := sha256.New()
+	io.WriteString(h, sum+"\n")
+	for _, include := range includes {
+		sum, err := FileHash(include)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, filepath.Base(include)+" "+sum+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// UpToDate reports whether runFile, stat'ed as rstat, was built from
+// sources whose digest is sum, as returned by SourceHash.  Timestamps
+// aren't reliable, going back with checkouts or kept by copies, so they
+// only tell for binaries built by versions of gorun that didn't record
+// the digest, which are up to date unless older than modTime.
+func UpToDate(runFile string, rstat os.FileInfo, sum string, modTime time.Time) bool {
+	meta, err := ReadMeta(runFile)
+	if err != nil || meta["source.sha256"] == "" {
+		return !rstat.ModTime().Before(modTime)
+	}
+	return meta["source.sha256"] == sum
+}
+
+// Binary verification modes, selected with GORUN_VERIFY.
+const (
+	VerifyOff     = "off"
+	VerifyRebuild = "rebuild"
+	VerifyEnforce = "enforce"
+)
+
+// VerifyMode returns how cached binaries are verified before being run.
+// With VerifyRebuild, the default, a binary not matching its recorded
+// hash is rebuilt; with VerifyEnforce gorun refuses to go on.
+func VerifyMode() (string, error) {
+	switch mode := os.Getenv("GORUN_VERIFY"); mode {
+	case "":
+		return VerifyRebuild, nil
+	case VerifyOff, VerifyRebuild, VerifyEnforce:
+		return mode, nil
+	default:
+		return "", errors.New("invalid GORUN_VERIFY: " + mode)
+	}
+}
+
+// VerifyBinary checks runFile against the hash recorded in its metadata.
+func VerifyBinary(runFile string) error {
+	meta, err := ReadMeta(runFile)
+	if err != nil {
+		return errors.New("no recorded hash for " + runFile)
+	}
+	sum, err := FileHash(runFile)
+	if err != nil {
+		return err
+	}
+	if meta["sha256"] == "" || meta["sha256"] != sum {
+		return errors.New("hash mismatch for " + runFile)
+	}
+	return nil
+}
+
+// DynamicLinking returns metadata describing how the ELF binary at path
+// is dynamically linked: its interpreter, the identity of the latter,
+// and the libraries it needs.  Nothing is returned for static binaries
+// or other formats.
+func DynamicLinking(path string) Meta {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var interp string
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, err := ioutil.ReadAll(prog.Open())
+			if err != nil {
+				return nil
+			}
+			interp = strings.TrimRight(string(data), "\x00")
+		}
+	}
+	if interp == "" {
+		return nil
+	}
+	meta := Meta{"interp": interp, "interp.id": fileIdentity(interp)}
+	if libs, err := f.ImportedLibraries(); err == nil {
+		meta["libs"] = strings.Join(libs, ",")
+	}
+	return meta
+}
+
+// DynamicLinkingChanged reports whether the dynamic linker recorded in
+// meta is gone or was replaced, as happens when the OS is upgraded,
+// which may leave the binary unable to run.
+func (meta Meta) DynamicLinkingChanged() bool {
+	interp := meta["interp"]
+	return interp != "" && fileIdentity(interp) != meta["interp.id"]
+}
+
+// fileIdentity returns a string that changes when the file at path is
+// replaced, or "" if it doesn't exist.
+func fileIdentity(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(info.Size(), 10) + " " + strconv.FormatInt(info.ModTime().UnixNano(), 10)
+}
+
+// setBuildMetadata sets the environment variables telling the script
+// of runFile which build of itself runs: GORUN_BUILD_TIME, in RFC 3339
+// format, GORUN_GO_VERSION, GORUN_BINARY_HASH and GORUN_CACHE_DIR.
+// Those that aren't known are unset, as they may have been inherited
+// from another script.
+func setBuildMetadata(runFile string) {
+	vars := map[string]string{}
+	meta, _ := ReadMeta(runFile)
+	if stat, err := os.Stat(MetaFile(runFile)); err == nil {
+		// The binary has the modification time of its source.
+		vars["GORUN_BUILD_TIME"] = stat.ModTime().UTC().Format(time.RFC3339)
+	}
+	vars["GORUN_GO_VERSION"] = meta["goversion"]
+	vars["GORUN_BINARY_HASH"] = meta["sha256"]
+	if runBaseDir, err := RunBaseDir(); err == nil {
+		vars["GORUN_CACHE_DIR"] = runBaseDir
+	}
+	for name, value := range vars {
+		if value != "" {
+			os.Setenv(name, value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
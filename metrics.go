@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScriptMetrics holds the usage counters recorded for a script.
+type ScriptMetrics struct {
+	Script    string
+	Runs      int64
+	Builds    int64
+	BuildTime time.Duration
+	LastRun   time.Time
+}
+
+// MetricsEnabled reports whether usage metrics are recorded, which is
+// opted in by setting GORUN_METRICS.
+func MetricsEnabled() (bool, error) {
+	value := os.Getenv("GORUN_METRICS")
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid GORUN_METRICS: " + value)
+	}
+	return enabled, nil
+}
+
+// MetricsFile returns the file usage metrics are recorded in.  It's
+// kept above runBaseDir so that it's shared by all architectures and
+// never subject to the cache cleaning.
+func MetricsFile(runBaseDir string) string {
+	return filepath.Join(filepath.Dir(runBaseDir), "metrics")
+}
+
+// ReadMetrics reads the usage metrics recorded in file.
+func ReadMetrics(file string) ([]ScriptMetrics, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseMetrics(data), nil
+}
+
+// parseMetrics parses metrics lines made of tab separated fields: the
+// script path, runs, builds, build nanoseconds and last run Unix time.
+func parseMetrics(data []byte) []ScriptMetrics {
+	var metrics []ScriptMetrics
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		var m ScriptMetrics
+		m.Script = fields[0]
+		m.Runs, _ = strconv.ParseInt(fields[1], 10, 64)
+		m.Builds, _ = strconv.ParseInt(fields[2], 10, 64)
+		buildTime, _ := strconv.ParseInt(fields[3], 10, 64)
+		m.BuildTime = time.Duration(buildTime)
+		lastRun, _ := strconv.ParseInt(fields[4], 10, 64)
+		m.LastRun = time.Unix(lastRun, 0)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// RecordRun adds a run of script to the usage metrics in file, and a
+// build taking buildTime if it's not zero.  The file is locked while
+// being updated since scripts may be run concurrently.
+func RecordRun(file, script string, now time.Time, buildTime time.Duration) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := lockFile(f, true); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	metrics := parseMetrics(data)
+	i := 0
+	for i < len(metrics) && metrics[i].Script != script {
+		i++
+	}
+	if i == len(metrics) {
+		metrics = append(metrics, ScriptMetrics{Script: script})
+	}
+	m := &metrics[i]
+	m.Runs++
+	m.LastRun = now
+	if buildTime > 0 {
+		m.Builds++
+		m.BuildTime += buildTime
+	}
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "%s\t%d\t%d\t%d\t%d\n", m.Script, m.Runs, m.Builds, int64(m.BuildTime), m.LastRun.Unix())
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+func recordRun(runBaseDir, sourcefile string, now time.Time, buildTime time.Duration) error {
+	script, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return err
+	}
+	return RecordRun(MetricsFile(runBaseDir), script, now, buildTime)
+}
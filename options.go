@@ -0,0 +1,709 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// Options holds the gorun settings given on the command line before
+// the script or subcommand.
+type Options struct {
+	// PGO selects the profile used for profile-guided optimization.
+	// An empty value leaves the choice to go build, "off" disables it,
+	// "default" uses default.pgo next to the script if there is one,
+	// and anything else is the path of a profile.
+	PGO string
+
+	// GOOS and GOARCH select the platform scripts are built for, by
+	// default the one gorun runs on.  Binaries built for another
+	// platform are cached apart, and can't be run.
+	GOOS   string
+	GOARCH string
+
+	// GOAMD64, GOARM and GOARM64 select the microarchitecture level
+	// targeted on the respective architectures, overriding the
+	// //gorun:goamd64, //gorun:goarm and //gorun:goarm64 pragmas.
+	GOAMD64 string
+	GOARM   string
+	GOARM64 string
+
+	// Compiler is the compiler used to build scripts: gc or gccgo.
+	Compiler string
+
+	// ExecAttempts is how many times running the binary is attempted
+	// when it gets removed from the cache before it can be executed,
+	// waiting ExecBackoff before the second attempt and doubling the
+	// wait before each of the following ones.
+	ExecAttempts int
+	ExecBackoff  time.Duration
+
+	// Child runs the script as a child process of gorun rather than
+	// replacing gorun with it.
+	Child bool
+
+	// LogDriver sends the script output and lifecycle events to the
+	// given logging backend, journald or syslog.  It implies Child.
+	LogDriver string
+
+	// Rusage reports the resources used by the script, formatted as
+	// text or json, on stderr once it's done.  It implies Child.
+	Rusage string
+
+	// Profile selects a named set of build flags, debug or release,
+	// overriding the //gorun:profile pragma.
+	Profile string
+
+	// ModCache is the module cache used by builds, overriding the
+	// //gorun:modcache pragma and GORUN_MODCACHE.
+	ModCache string
+
+	// ReportSignal prints which signal killed the script, if one did.
+	// It implies Child.
+	ReportSignal bool
+
+	// Sudo runs the binary as root with sudo, or the command in
+	// GORUN_SUDO, once built as the invoking user.
+	Sudo bool
+
+	// Direnv loads the .envrc of the script's directory with direnv
+	// into the environment the script runs with.
+	Direnv bool
+
+	// StrictDeps fails builds importing modules the script's go.mod
+	// doesn't require, rather than letting go build add them.
+	StrictDeps bool
+
+	// Daemon starts the script in the background, detached from the
+	// terminal, with its output appended to DaemonLog and its pid
+	// written to PidFile if set.
+	Daemon    bool
+	DaemonLog string
+	PidFile   string
+
+	// DepsBundle is a bundle made by gorun vendor-bundle that modules
+	// are fetched from instead of the network.
+	DepsBundle string
+
+	// Template renders the script with text/template before building
+	// it, with the environment and TemplateValues as data.
+	Template       bool
+	TemplateValues stringList
+
+	// CI fails builds on go vet findings and C compiler warnings, and
+	// reports the outcome as JSON on stderr.  It implies Child.
+	CI bool
+
+	// VerifyManifest refuses to run scripts that don't match their
+	// checksum in the gorun.sum file of their directory.
+	VerifyManifest bool
+
+	// Insecure runs scripts given by URL without a #sha256= checksum
+	// pinning their contents.
+	Insecure bool
+
+	// Record records the arguments, environment, standard input and
+	// binary of the run under the given name for gorun replay.
+	Record string
+	// recordedStdin is set once the standard input was recorded.
+	recordedStdin bool
+	// replayed is the checksum of the binary of the run being replayed.
+	replayed string
+	// cleanup, if set, is called once the script is built, before it
+	// runs, to remove what only the build needs.
+	cleanup func()
+
+	// BuildFlags holds go build flags given to gorun go-run, and
+	// ExecWrapper the program the binary is run with, as with the -exec
+	// flag of go run.
+	BuildFlags  []string
+	ExecWrapper string
+
+	// Work rebuilds the script keeping the build's temporary files,
+	// and reports where they are.
+	Work bool
+
+	// AutoMod makes a go.mod for scripts importing packages from
+	// outside the standard library without a go.mod, neither embedded
+	// nor in a directory above, as go mod init and go mod tidy would.
+	AutoMod bool
+
+	// Force rebuilds the script even if its binary looks up to date,
+	// for changes gorun doesn't track, such as to a locally replaced
+	// module.
+	Force bool
+
+	// Help prints the usage section of the script instead of running
+	// it, or the usage of gorun if no script is given.
+	Help bool
+
+	// Version prints the version of gorun.
+	Version bool
+
+	// Watch restarts the script whenever it or the files its build
+	// depends on change.
+	Watch bool
+}
+
+// AddFlags registers the command line flags setting opts.
+func (opts *Options) AddFlags(flags *flag.FlagSet) {
+	flags.StringVar(&opts.PGO, "pgo", "", "profile for profile-guided optimization: default, off or a path")
+	flags.StringVar(&opts.GOOS, "goos", "", "operating system to build for (default: the host's)")
+	flags.StringVar(&opts.GOARCH, "goarch", "", "architecture to build for (default: the host's)")
+	flags.StringVar(&opts.GOAMD64, "goamd64", "", "amd64 microarchitecture level (v1, v2, v3 or v4)")
+	flags.StringVar(&opts.GOARM, "goarm", "", "arm architecture version (5, 6 or 7)")
+	flags.StringVar(&opts.GOARM64, "goarm64", "", "arm64 architecture version (v8.0 to v9.5)")
+	flags.StringVar(&opts.Compiler, "compiler", "gc", "compiler to build with: gc or gccgo")
+	flags.IntVar(&opts.ExecAttempts, "exec-attempts", 3, "times to attempt running a binary removed from the cache meanwhile")
+	flags.DurationVar(&opts.ExecBackoff, "exec-backoff", 0, "wait before attempting to run the binary again, doubled on each attempt")
+	flags.BoolVar(&opts.Child, "child", false, "run the script as a child process instead of replacing gorun")
+	flags.StringVar(&opts.LogDriver, "log-driver", "", "send the script output to journald or syslog (implies --child)")
+	flags.StringVar(&opts.Rusage, "rusage", "", "report the script resource usage on stderr as text or json (implies --child)")
+	flags.StringVar(&opts.Profile, "profile", "", "build profile: debug (no optimizations) or release (stripped, trimmed paths)")
+	flags.StringVar(&opts.ModCache, "modcache", "", "module cache to build with (GOMODCACHE)")
+	flags.BoolVar(&opts.ReportSignal, "report-signal", false, "print which signal killed the script, if one did (implies --child)")
+	flags.BoolVar(&opts.Sudo, "sudo", false, "build as the invoking user, then run the script as root with sudo (or GORUN_SUDO)")
+	flags.BoolVar(&opts.Direnv, "direnv", false, "run the script with the environment direnv loads from its directory's .envrc")
+	flags.BoolVar(&opts.StrictDeps, "strict-deps", false, "fail builds importing modules the script's go.mod doesn't require")
+	flags.BoolVar(&opts.Daemon, "daemon", false, "start the script in the background, detached from the terminal")
+	flags.StringVar(&opts.DaemonLog, "daemon-log", "", "file the output of a daemon is appended to (default: <script>.log)")
+	flags.StringVar(&opts.PidFile, "pidfile", "", "file to write the pid of a daemon to")
+	flags.BoolVar(&opts.VerifyManifest, "verify-manifest", false, "refuse to run scripts not matching their checksum in the gorun.sum of their directory")
+	flags.BoolVar(&opts.Insecure, "insecure", false, "run scripts given by URL without a #sha256= checksum")
+	flags.StringVar(&opts.Record, "record", "", "record the inputs of the run under a name, to run it again with gorun replay")
+	flags.StringVar(&opts.DepsBundle, "deps-bundle", "", "fetch modules from a bundle made by gorun vendor-bundle instead of the network")
+	flags.BoolVar(&opts.Template, "template", false, "render the script with text/template, from the environment and --set values, before building it")
+	flags.Var(&opts.TemplateValues, "set", "name=value for --template, overriding the environment (repeatable)")
+	flags.BoolVar(&opts.CI, "ci", false, "fail on go vet findings and compiler warnings, reporting results as JSON (implies --child)")
+	flags.BoolVar(&opts.Work, "work", false, "rebuild keeping and printing the build's temporary files")
+	flags.BoolVar(&opts.AutoMod, "auto-mod", false, "resolve the modules imported by scripts without a go.mod with go mod tidy")
+	flags.BoolVar(&opts.Force, "force", false, "rebuild the script even if its binary looks up to date")
+	flags.BoolVar(&opts.Force, "f", false, "shorthand for --force")
+	flags.BoolVar(&opts.Help, "help", false, "print the usage section of the script")
+	flags.BoolVar(&opts.Version, "version", false, "print the version of gorun, as gorun version does")
+	flags.BoolVar(&opts.Watch, "watch", false, "rebuild and restart the script whenever it or its dependencies change")
+	flags.BoolVar(&opts.Watch, "w", false, "shorthand for --watch")
+}
+
+// AddCommandFlags registers the command line flags setting opts for a
+// command, keeping the values opts has from the default flags and the
+// flags given before the command, which it shows as the defaults.
+func (opts *Options) AddCommandFlags(flags *flag.FlagSet) {
+	current := *opts
+	opts.AddFlags(flags)
+	*opts = current
+	flags.VisitAll(func(f *flag.Flag) {
+		f.DefValue = f.Value.String()
+	})
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// DefaultFlags returns the flags taken before those on the command
+// line: the ones in the flags file of the user's gorun configuration
+// directory, where lines starting with # are comments, followed by the
+// ones in GORUN_FLAGS, so that the latter win.
+func DefaultFlags() ([]string, error) {
+	var data []byte
+	if dir := configDir(); dir != "" {
+		var err error
+		data, err = ioutil.ReadFile(filepath.Join(dir, "flags"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	envFlags, err := envSettings("flags")
+	if err != nil {
+		return nil, err
+	}
+	var defaults []string
+	for _, line := range strings.Split(string(data)+"\n"+string(envFlags), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			defaults = append(defaults, strings.Fields(line)...)
+		}
+	}
+	defaults = append(defaults, strings.Fields(os.Getenv("GORUN_FLAGS"))...)
+	// Flags taking a value may have it in the next word, as on the
+	// command line.
+	known := flag.NewFlagSet("gorun", flag.ContinueOnError)
+	new(Options).AddFlags(known)
+	for i := 0; i < len(defaults); i++ {
+		arg := defaults[i]
+		if !strings.HasPrefix(arg, "-") {
+			return nil, errors.New("not a flag in the default flags: " + arg)
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := known.Lookup(name); f != nil && !isBoolFlag(f) {
+			if i+1 == len(defaults) {
+				return nil, errors.New("missing value of " + arg + " in the default flags")
+			}
+			i++
+		}
+	}
+	return defaults, nil
+}
+
+// isBoolFlag reports whether f is a flag given without a value, as the
+// flag package tells.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// configDir returns the gorun configuration directory of the user, or
+// "" if there's none.
+func configDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "gorun")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config", "gorun")
+	}
+	return ""
+}
+
+// ChildMode reports whether opts require running the script as a child
+// process of gorun.
+func (opts *Options) ChildMode() bool {
+	return opts.Child || opts.LogDriver != "" || opts.Rusage != "" || opts.ReportSignal || opts.CI
+}
+
+// Validate checks opts for settings that can't be used.
+func (opts *Options) Validate() error {
+	switch opts.LogDriver {
+	case "", "journald", "syslog":
+	default:
+		return errors.New("unknown log driver: " + opts.LogDriver)
+	}
+	switch opts.Rusage {
+	case "", "text", "json":
+	default:
+		return errors.New("unknown resource usage format: " + opts.Rusage)
+	}
+	if opts.Daemon && opts.ChildMode() {
+		return errors.New("--daemon can't be used with --child, --log-driver, --rusage, --report-signal or --ci")
+	}
+	if opts.Sudo && (opts.Daemon || opts.ChildMode()) {
+		return errors.New("--sudo can't be used with --daemon, nor with --child and the flags implying it")
+	}
+	if opts.Daemon && opts.Record != "" {
+		return errors.New("--record can't be used with --daemon")
+	}
+	if opts.ExecWrapper != "" && (opts.Sudo || opts.Daemon || opts.ChildMode()) {
+		return errors.New("-exec can't be used with --sudo, --daemon, nor with --child and the flags implying it")
+	}
+	if !opts.Daemon && (opts.PidFile != "" || opts.DaemonLog != "") {
+		return errors.New("--pidfile and --daemon-log need --daemon")
+	}
+	for _, value := range opts.TemplateValues {
+		if strings.Index(value, "=") <= 0 {
+			return errors.New("invalid template value, expected name=value: " + value)
+		}
+	}
+	if len(opts.TemplateValues) > 0 && !opts.Template {
+		return errors.New("--set needs --template")
+	}
+	if opts.ExecAttempts < 1 {
+		return errors.New("invalid number of exec attempts: " + strconv.Itoa(opts.ExecAttempts))
+	}
+	return nil
+}
+
+// BuildSettings describes how a script is built beyond what's embedded
+// in its sections.
+type BuildSettings struct {
+	// Flags holds additional go build flags.
+	Flags []string
+	// Env holds additional environment variables for go build.
+	Env []string
+	// Key holds key=value pairs identifying the settings that affect
+	// the resulting binary, so differently built binaries are kept
+	// apart in the cache.
+	Key []string
+	// Work keeps the build's temporary files and reports where they are.
+	Work bool
+	// Diagnostics receives the problems reported by go build, instead
+	// of stderr.
+	Diagnostics io.Writer
+	// GoMod and GoSum hold the go.mod and go.sum referenced by the
+	// //gorun:gomod pragma, used when the script has no go.mod section.
+	GoMod []byte
+	GoSum []byte
+	// Requires holds the module@version requirements given by the
+	// //gorun:require pragmas of a script without a go.mod, which is
+	// then made from them.
+	Requires []string
+	// AutoMod makes a go.mod with go mod tidy for scripts importing
+	// modules without having a go.mod.
+	AutoMod bool
+	// Vet runs go vet on the script before building it, failing the
+	// build on its findings.
+	Vet bool
+	// Source holds the output of the //gorun:preprocess commands, or
+	// the rendered template, built instead of the script, or nil if
+	// the script is built as is.
+	Source []byte
+	// Capabilities holds the Linux file capabilities granted to the
+	// binary once built, from the //gorun:setcap pragmas.
+	Capabilities string
+	// Includes holds the absolute paths of the files named by the
+	// //gorun:include pragmas, built along with the script.
+	Includes []string
+	// Target is the platform the script is built for when it isn't
+	// the host, or the zero Target otherwise.
+	Target Target
+}
+
+// buildProfiles are the named sets of go build flags selected with
+// --profile or the //gorun:profile pragma.
+var buildProfiles = map[string][]string{
+	"debug":   {"-gcflags=all=-N -l"},
+	"release": {"-trimpath", "-ldflags=-s -w"},
+}
+
+var (
+	validGOAMD64 = regexp.MustCompile(`^v[1-4]$`)
+	validGOARM   = regexp.MustCompile(`^[567](,(softfloat|hardfloat))?$`)
+	validGOARM64 = regexp.MustCompile(`^v(8\.[0-9]|9\.[0-5])(,(lse|crypto))*$`)
+)
+
+// BuildSettings returns the settings implied by opts and the pragmas
+// in content when building sourcefile.
+func (opts *Options) BuildSettings(sourcefile string, content []byte) (*BuildSettings, error) {
+	build := &BuildSettings{Work: opts.Work, AutoMod: opts.AutoMod}
+	if opts.Work {
+		build.Flags = append(build.Flags, "-work")
+	}
+	switch opts.PGO {
+	case "":
+	case "off":
+		build.Flags = append(build.Flags, "-pgo=off")
+		build.Key = append(build.Key, "pgo=off")
+	default:
+		profile := opts.PGO
+		if profile == "default" {
+			profile = filepath.Join(filepath.Dir(sourcefile), "default.pgo")
+			if _, err := os.Stat(profile); err != nil {
+				break
+			}
+		}
+		profile, err := filepath.Abs(profile)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := FileHash(profile)
+		if err != nil {
+			return nil, errors.New("can't read profile: " + err.Error())
+		}
+		build.Flags = append(build.Flags, "-pgo="+profile)
+		build.Key = append(build.Key, "pgo="+sum)
+	}
+
+	switch opts.Compiler {
+	case "", "gc":
+	case "gccgo":
+		if opts.PGO != "" && opts.PGO != "off" {
+			return nil, errors.New("profile-guided optimization isn't supported by gccgo")
+		}
+		build.Flags = append(build.Flags, "-compiler=gccgo")
+		build.Key = append(build.Key, "compiler=gccgo")
+	default:
+		return nil, errors.New("unknown compiler: " + opts.Compiler)
+	}
+
+	if opts.GOOS != "" || opts.GOARCH != "" {
+		target := Target{opts.GOOS, opts.GOARCH}
+		if target.GOOS == "" {
+			target.GOOS = runtime.GOOS
+		}
+		if target.GOARCH == "" {
+			target.GOARCH = runtime.GOARCH
+		}
+		if !validTarget.MatchString(target.String()) {
+			return nil, errors.New("invalid target: " + target.String())
+		}
+		if target != (Target{runtime.GOOS, runtime.GOARCH}) {
+			build.Target = target
+			build.Env = append(build.Env, "GOOS="+target.GOOS, "GOARCH="+target.GOARCH)
+		}
+	}
+
+	// The pragmas of the script override those of the environment.
+	envPragmas, err := envSettings("pragmas")
+	if err != nil {
+		return nil, err
+	}
+	pragmas := append(Pragmas(envPragmas), Pragmas(content)...)
+	levels := []struct {
+		name, value string
+		valid       *regexp.Regexp
+	}{
+		{"GOAMD64", opts.GOAMD64, validGOAMD64},
+		{"GOARM", opts.GOARM, validGOARM},
+		{"GOARM64", opts.GOARM64, validGOARM64},
+	}
+	for _, level := range levels {
+		value := level.value
+		if value == "" {
+			value = pragmaValue(pragmas, strings.ToLower(level.name))
+		}
+		if value != "" {
+			if !level.valid.MatchString(value) {
+				return nil, errors.New("invalid " + level.name + ": " + value)
+			}
+			build.Env = append(build.Env, level.name+"="+value)
+			build.Key = append(build.Key, strings.ToLower(level.name)+"="+value)
+		}
+	}
+	profile := opts.Profile
+	if profile == "" {
+		profile = pragmaValue(pragmas, "profile")
+	}
+	if profile != "" {
+		flags, ok := buildProfiles[profile]
+		if !ok {
+			return nil, errors.New("unknown build profile: " + profile)
+		}
+		build.Flags = append(build.Flags, flags...)
+		build.Key = append(build.Key, "profile="+profile)
+	}
+	if ref := pragmaValue(pragmas, "gomod"); ref != "" && len(gorun.Section(content, "go.mod")) == 0 {
+		mod, sum, err := ExternalGoMod(sourcefile, ref)
+		if err != nil {
+			return nil, errors.New("can't get go.mod: " + err.Error())
+		}
+		build.GoMod, build.GoSum = mod, sum
+		h := sha256.Sum256([]byte(string(mod) + "\x00" + string(sum)))
+		build.Key = append(build.Key, "gomod="+hex.EncodeToString(h[:8]))
+	}
+	if len(gorun.Section(content, "go.mod")) == 0 && len(build.GoMod) == 0 {
+		requires, err := requirePragmas(Pragmas(content))
+		if err != nil {
+			return nil, err
+		}
+		if len(requires) > 0 {
+			build.Requires = requires
+			build.GoMod = []byte("module " + strings.TrimSuffix(filepath.Base(sourcefile), ".go") + "\n")
+		}
+	}
+	if opts.StrictDeps && (len(gorun.Section(content, "go.mod")) > 0 || len(build.GoMod) > 0) {
+		// Overrides any -mod=mod from GOFLAGS, including in go.env.
+		build.Flags = append(build.Flags, "-mod=readonly")
+		build.Key = append(build.Key, "deps=strict")
+	}
+	// The flags of the command line come last, and win.
+	sectionFlags, err := SectionFlags(gorun.Section(content, "go.flags"))
+	if err != nil {
+		return nil, err
+	}
+	build.Flags = append(build.Flags, sectionFlags...)
+	if len(opts.BuildFlags) > 0 {
+		build.Flags = append(build.Flags, opts.BuildFlags...)
+		build.Key = append(build.Key, "flags="+strings.Join(opts.BuildFlags, " "))
+	}
+	if opts.CI {
+		build.Vet = true
+		build.Env = append(build.Env, ciBuildEnv()...)
+		build.Key = append(build.Key, "ci=1")
+	}
+	caps, err := capabilities(pragmas)
+	if err != nil {
+		return nil, err
+	}
+	if caps != "" {
+		build.Capabilities = caps
+		build.Key = append(build.Key, "setcap="+caps)
+	}
+	included, err := includedFiles(sourcefile, pragmas)
+	if err != nil {
+		return nil, err
+	}
+	build.Includes = included
+	modcache, err := opts.modCache(sourcefile, pragmas, content)
+	if err != nil {
+		return nil, err
+	}
+	if modcache != "" {
+		build.Env = append(build.Env, "GOMODCACHE="+modcache)
+	}
+	if opts.DepsBundle != "" {
+		bundleEnv, err := DepsBundleEnv(opts.DepsBundle)
+		if err != nil {
+			return nil, err
+		}
+		build.Env = append(build.Env, bundleEnv...)
+	}
+	gitEnv, err := gitConfigEnv(pragmas)
+	if err != nil {
+		return nil, err
+	}
+	build.Env = append(build.Env, gitEnv...)
+	if opts.Compiler == "gccgo" {
+		if build.Flags, err = gccgoFlags(build.Flags); err != nil {
+			return nil, err
+		}
+	}
+	return build, nil
+}
+
+// PrepareSource runs the script sourcefile with content through its
+// //gorun:preprocess commands and, with --template, renders it, into
+// build.Source.  Unlike BuildSettings it runs commands named by the
+// script, so it's only called on the way to building the script, once
+// it's been checked.
+func (opts *Options) PrepareSource(sourcefile string, content []byte, build *BuildSettings) error {
+	envPragmas, err := envSettings("pragmas")
+	if err != nil {
+		return err
+	}
+	source, err := Preprocess(sourcefile, append(Pragmas(envPragmas), Pragmas(content)...))
+	if err != nil {
+		return err
+	}
+	if opts.Template {
+		if source, err = RenderTemplate(sourcefile, source, opts.TemplateValues); err != nil {
+			return err
+		}
+	}
+	if source != nil {
+		// The binary depends on what the preprocessors and template
+		// made of the script, which may change even if it doesn't.
+		h := sha256.Sum256(source)
+		build.Source = source
+		build.Key = append(build.Key, "source="+hex.EncodeToString(h[:8]))
+	}
+	return nil
+}
+
+// includedFiles returns the absolute paths of the Go files named by the
+// //gorun:include pragmas in pragmas, relative to sourcefile.
+func includedFiles(sourcefile string, pragmas []Pragma) ([]string, error) {
+	var paths []string
+	names := map[string]bool{filepath.Base(sourcefile): true}
+	for _, pragma := range pragmas {
+		if pragma.Name != "include" {
+			continue
+		}
+		if len(pragma.Args) == 0 {
+			return nil, errors.New("usage: //gorun:include <file.go>...")
+		}
+		for _, name := range pragma.Args {
+			path := name
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(sourcefile), path)
+			}
+			path, err := filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
+			if filepath.Ext(path) != ".go" {
+				return nil, errors.New("can't include " + name + ": not a Go file")
+			}
+			if names[filepath.Base(path)] {
+				return nil, errors.New("can't include " + name + ": another file of the build has the same name")
+			}
+			names[filepath.Base(path)] = true
+			if _, err := os.Stat(path); err != nil {
+				return nil, errors.New("can't include " + name + ": " + err.Error())
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// gitConfigEnv returns environment variables passing the git settings
+// from the //gorun:git-config and //gorun:git-insteadof pragmas to the
+// git commands run by go build when fetching modules, in addition to
+// any already given with GIT_CONFIG_COUNT.  For instance
+//
+//	//gorun:git-insteadof git@github.com:mycorp/ https://github.com/mycorp/
+//
+// fetches the mycorp modules over SSH, authenticating with the user's
+// SSH agent or keys.
+func gitConfigEnv(pragmas []Pragma) ([]string, error) {
+	var config [][2]string
+	for _, pragma := range pragmas {
+		switch pragma.Name {
+		case "git-config":
+			if len(pragma.Args) < 2 {
+				return nil, errors.New("usage: //gorun:git-config <key> <value>")
+			}
+			config = append(config, [2]string{pragma.Args[0], strings.Join(pragma.Args[1:], " ")})
+		case "git-insteadof":
+			if len(pragma.Args) != 2 {
+				return nil, errors.New("usage: //gorun:git-insteadof <url> <prefix>")
+			}
+			config = append(config, [2]string{"url." + pragma.Args[0] + ".insteadOf", pragma.Args[1]})
+		}
+	}
+	if len(config) == 0 {
+		return nil, nil
+	}
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	var env []string
+	for _, kv := range config {
+		n := strconv.Itoa(count)
+		env = append(env, "GIT_CONFIG_KEY_"+n+"="+kv[0], "GIT_CONFIG_VALUE_"+n+"="+kv[1])
+		count++
+	}
+	return append(env, "GIT_CONFIG_COUNT="+strconv.Itoa(count)), nil
+}
+
+// gccgoFlags translates the gc specific go build flags in flags to
+// their gccgo equivalents.  Having no equivalent, -pgo is dropped;
+// BuildSettings refuses profiles other than off for gccgo builds.  The
+// flags of the debug profile are the only -gcflags translated, as gc
+// and gccgo take different options: others are refused.
+func gccgoFlags(flags []string) ([]string, error) {
+	var translated []string
+	for _, flag := range flags {
+		name := strings.SplitN(strings.TrimPrefix(flag, "-"), "=", 2)[0]
+		switch {
+		case flag == "-gcflags=all=-N -l":
+			// The debug profile.
+			flag = "-gccgoflags=all=-O0 -g"
+		case name == "-gcflags" || name == "gcflags":
+			return nil, errors.New("gccgo doesn't take gc compiler flags, use -gccgoflags instead of " + flag)
+		case strings.HasPrefix(flag, "-pgo="):
+			continue
+		}
+		translated = append(translated, flag)
+	}
+	return translated, nil
+}
+
+// keySuffix returns the suffix distinguishing binaries built with the
+// settings in key, or "" for the default settings.
+func keySuffix(key []string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(key, "\n")))
+	return "." + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseCommand parses args as main does with the default flags, then
+// the flags of the build command, and returns the resulting options.
+func parseCommand(t *testing.T, args []string) *Options {
+	defaults, err := DefaultFlags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts Options
+	flags := flag.NewFlagSet("gorun", flag.ContinueOnError)
+	opts.AddFlags(flags)
+	if err := flags.Parse(append(defaults, args...)); err != nil {
+		t.Fatal(err)
+	}
+	args = flags.Args()
+	if len(args) == 0 || args[0] != "build" {
+		t.Fatalf("no build command in %q", args)
+	}
+	build := flag.NewFlagSet("build", flag.ContinueOnError)
+	opts.AddCommandFlags(build)
+	build.String("o", "", "")
+	if err := build.Parse(args[1:]); err != nil {
+		t.Fatal(err)
+	}
+	return &opts
+}
+
+func TestDefaultFlagsReachCommands(t *testing.T) {
+	config, err := ioutil.TempDir("", "gorun-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(config)
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	defer os.Setenv("GORUN_FLAGS", os.Getenv("GORUN_FLAGS"))
+	defer os.Setenv("GORUN_ENV", os.Getenv("GORUN_ENV"))
+	os.Setenv("XDG_CONFIG_HOME", config)
+	os.Unsetenv("GORUN_ENV")
+
+	tests := []struct {
+		env      string
+		args     []string
+		goos     string
+		compiler string
+	}{
+		{"", []string{"build", "s.go"}, "", "gc"},
+		{"--goos=windows", []string{"build", "-o", "x", "s.go"}, "windows", "gc"},
+		{"", []string{"--goos=windows", "build", "s.go"}, "windows", "gc"},
+		{"", []string{"build", "--goos=windows", "s.go"}, "windows", "gc"},
+		{"--goos=windows", []string{"--goos=linux", "build", "s.go"}, "linux", "gc"},
+		{"--goos=windows", []string{"build", "--goos=darwin", "s.go"}, "darwin", "gc"},
+		{"--compiler=gccgo", []string{"--goos=windows", "build", "s.go"}, "windows", "gccgo"},
+		{"--goos windows", []string{"build", "s.go"}, "windows", "gc"},
+		{"--strict-deps -goos windows --compiler gccgo", []string{"build", "s.go"}, "windows", "gccgo"},
+	}
+	for _, test := range tests {
+		os.Setenv("GORUN_FLAGS", test.env)
+		opts := parseCommand(t, test.args)
+		if opts.GOOS != test.goos || opts.Compiler != test.compiler {
+			t.Errorf("GORUN_FLAGS=%q gorun %q: got GOOS %q and compiler %q, want %q and %q",
+				test.env, test.args, opts.GOOS, opts.Compiler, test.goos, test.compiler)
+		}
+	}
+}
+
+func TestDefaultFlagValues(t *testing.T) {
+	config, err := ioutil.TempDir("", "gorun-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(config)
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	defer os.Setenv("GORUN_FLAGS", os.Getenv("GORUN_FLAGS"))
+	defer os.Setenv("GORUN_ENV", os.Getenv("GORUN_ENV"))
+	os.Setenv("XDG_CONFIG_HOME", config)
+	os.Unsetenv("GORUN_ENV")
+	if err := os.MkdirAll(filepath.Join(config, "gorun"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file, env string
+		ok        bool
+	}{
+		{"--modcache /x\n", "", true},
+		{"", "--modcache /x --strict-deps", true},
+		{"--modcache\n/x\n", "", true},
+		{"--modcache=/x\n", "--goos windows", true},
+		{"", "--modcache", false},
+		{"", "--strict-deps /x", false},
+		{"", "s.go", false},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(filepath.Join(config, "gorun", "flags"), []byte(test.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("GORUN_FLAGS", test.env)
+		if defaults, err := DefaultFlags(); (err == nil) != test.ok {
+			t.Errorf("flags file %q and GORUN_FLAGS=%q: got %q, %v", test.file, test.env, defaults, err)
+		}
+	}
+}
+
+func TestGccgoFlags(t *testing.T) {
+	tests := []struct {
+		flags, translated []string
+		ok                bool
+	}{
+		{[]string{"-trimpath"}, []string{"-trimpath"}, true},
+		{[]string{"-gcflags=all=-N -l"}, []string{"-gccgoflags=all=-O0 -g"}, true},
+		{[]string{"-pgo=default.pgo", "-race"}, []string{"-race"}, true},
+		{[]string{"-gcflags=-m"}, nil, false},
+		{[]string{"--gcflags=all=-N"}, nil, false},
+		{[]string{"-gcflags", "-m"}, nil, false},
+	}
+	for _, test := range tests {
+		translated, err := gccgoFlags(test.flags)
+		if (err == nil) != test.ok || strings.Join(translated, " ") != strings.Join(test.translated, " ") {
+			t.Errorf("gccgoFlags(%q) = %q, %v", test.flags, translated, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// exeSuffix is the suffix of executable files.
+const exeSuffix = ""
+
+// safeOpenFlags are the flags opening files in directories shared with
+// other users: symlinks aren't followed, and FIFOs don't block.
+const safeOpenFlags = syscall.O_NOFOLLOW | syscall.O_NONBLOCK
+
+// canExec tells whether gorun can replace itself with the script it
+// runs.
+const canExec = true
+
+// userSignals are the signals left to programs to use as they see fit.
+var userSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
+
+func init() {
+	signalNames[syscall.SIGUSR1] = "SIGUSR1"
+	signalNames[syscall.SIGUSR2] = "SIGUSR2"
+	signalNames[syscall.SIGXCPU] = "SIGXCPU"
+	signalNames[syscall.SIGXFSZ] = "SIGXFSZ"
+}
+
+func sysStat(stat os.FileInfo) *syscall.Stat_t {
+	return stat.Sys().(*syscall.Stat_t)
+}
+
+// pageFaults returns the minor and major page faults in ru.
+func pageFaults(ru *syscall.Rusage) (minor, major int64) {
+	return int64(ru.Minflt), int64(ru.Majflt)
+}
+
+// detached returns the attributes of a process running in a session of
+// its own, detached from the terminal.
+func detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// lockFile locks f exclusively, waiting for the lock to be released if
+// wait is true.  Otherwise false is returned if f is locked already.
+func lockFile(f *os.File, wait bool) (bool, error) {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	err := syscall.Flock(int(f.Fd()), how)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// processStartTime returns when the process pid started, in a form only
+// meant to be compared, to tell it apart from a later process given the
+// same pid.  It's read from /proc where there's one, or else from ps.
+func processStartTime(pid int) (string, error) {
+	if data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil {
+		// The command name, in parentheses, may hold spaces.
+		fields := bytes.Fields(data[bytes.LastIndexByte(data, ')')+1:])
+		if len(fields) < 20 {
+			return "", errors.New("unexpected /proc/" + strconv.Itoa(pid) + "/stat")
+		}
+		// starttime, the 22nd field.
+		return string(fields[19]), nil
+	}
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", errors.New("can't tell when process " + strconv.Itoa(pid) + " started")
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// stopProcess asks the process pid to terminate.
+func stopProcess(pid int) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// killProcess terminates the process pid right away.
+func killProcess(pid int) {
+	syscall.Kill(pid, syscall.SIGKILL)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// exeSuffix is the suffix of executable files.
+const exeSuffix = ".exe"
+
+// safeOpenFlags are the flags opening files in directories shared with
+// other users, which Windows doesn't have.
+const safeOpenFlags = 0
+
+// canExec tells whether gorun can replace itself with the script it
+// runs.  Windows has no exec: scripts run as child processes.
+const canExec = false
+
+// userSignals are the signals left to programs to use as they see fit.
+var userSignals []os.Signal
+
+// fileOwner is the owner of a file.
+type fileOwner struct {
+	Uid, Gid uint32
+}
+
+// sysStat returns the owner of the file stat.  Windows controls access
+// with ACLs rather than owners and modes: files are taken to be the
+// user's own.
+func sysStat(stat os.FileInfo) *fileOwner {
+	return &fileOwner{uint32(os.Geteuid()), uint32(os.Getegid())}
+}
+
+// pageFaults returns the minor and major page faults in ru, which
+// Windows doesn't report.
+func pageFaults(ru *syscall.Rusage) (minor, major int64) {
+	return 0, 0
+}
+
+// detachedProcess is the process creation flag detaching a process from
+// the console.
+const detachedProcess = 0x00000008
+
+// detached returns the attributes of a process detached from the
+// console.
+func detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
+
+var (
+	kernel32       = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx = kernel32.NewProc("LockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile locks f exclusively, waiting for the lock to be released if
+// wait is true.  Otherwise false is returned if f is locked already.
+func lockFile(f *os.File, wait bool) (bool, error) {
+	flags := uintptr(lockfileExclusiveLock)
+	if !wait {
+		flags |= lockfileFailImmediately
+	}
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+)
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
+
+// processStartTime returns when the process pid started, in a form only
+// meant to be compared, to tell it apart from a later process given the
+// same pid.
+func processStartTime(pid int) (string, error) {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(h)
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(creation.Nanoseconds(), 10), nil
+}
+
+// stopProcess asks the process pid to terminate.  Windows has no way to
+// ask, so it's terminated right away.
+func stopProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		// It's gone already.
+		return nil
+	}
+	defer p.Release()
+	if err := p.Kill(); err != nil && processAlive(pid) {
+		return err
+	}
+	return nil
+}
+
+// killProcess terminates the process pid right away.
+func killProcess(pid int) {
+	stopProcess(pid)
+}
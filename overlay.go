@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// overlaySupported reports whether gotool can build with the settings
+// in build using an overlay, which needs Go 1.16 and the gc compiler.
+func overlaySupported(gotool string, build *BuildSettings) bool {
+	for _, flag := range build.Flags {
+		if flag == "-compiler=gccgo" {
+			return false
+		}
+	}
+	version, err := GoVersion(gotool)
+	return err == nil && versionAtLeast(version, "1.16")
+}
+
+// writeOverlay writes the go build overlay building sourcefile where it
+// is, along with the files included in the build, as if the go.mod and
+// go.sum written in runCmdDir were next to it.  Only a script that needs
+// rewriting, having a byte order mark or a bang line, or that was
+// preprocessed into source, is copied, the copy standing in for the
+// original.  The files contributed by sections, in runCmdDir, are laid
+// over the directory too.  It returns the overlay file, the
+// files to build, and the temporary files it wrote, the overlay among
+// them.
+func writeOverlay(sourcefile, runFile, runCmdDir string, scan *scriptScan, writtenSum bool, includes []string, source []byte, contributed []string) (overlay string, sources, temps []string, err error) {
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dir := filepath.Dir(path)
+	pid := strconv.Itoa(os.Getpid())
+	replace := map[string]string{
+		filepath.Join(dir, "go.mod"): filepath.Join(runCmdDir, "go.mod"),
+		// An empty replacement hides a go.sum the script doesn't have.
+		filepath.Join(dir, "go.sum"): "",
+	}
+	if writtenSum {
+		replace[filepath.Join(dir, "go.sum")] = filepath.Join(runCmdDir, "go.sum")
+	}
+	if scan.bom || scan.shebang || scan.headerLines > 0 || source != nil {
+		copied := runFile + "." + pid + ".go"
+		if err := writeSource(sourcefile, copied, scan, source); err != nil {
+			return "", nil, nil, err
+		}
+		temps = append(temps, copied)
+		replace[path] = copied
+	}
+	sources = []string{path}
+	for _, include := range includes {
+		// go build wants all the files in one directory.
+		inDir := filepath.Join(dir, filepath.Base(include))
+		if inDir != include {
+			replace[inDir] = include
+		}
+		sources = append(sources, inDir)
+	}
+	for _, file := range contributed {
+		inDir := filepath.Join(dir, filepath.Base(file))
+		replace[inDir] = file
+		if filepath.Ext(file) == ".go" {
+			sources = append(sources, inDir)
+		}
+	}
+	data, err := json.Marshal(struct{ Replace map[string]string }{replace})
+	if err != nil {
+		return "", nil, temps, err
+	}
+	overlay = runFile + "." + pid + ".overlay.json"
+	if err := ioutil.WriteFile(overlay, data, 0600); err != nil {
+		return "", nil, temps, err
+	}
+	return overlay, sources, append(temps, overlay), nil
+}
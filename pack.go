@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// packModule is the module path of the program made by PackMulti.
+const packModule = "gorun.pack"
+
+// PackMulti builds the scripts sourcefiles into a single multi-call
+// binary at output, which runs the script named after the name it's
+// invoked with, or after its first argument, like busybox does.  The
+// name of a script is its file name without the .go extension.
+//
+// Each script becomes a package of its own, with its main function
+// renamed, and the modules required by the scripts are merged, the
+// highest version of each being used.
+func PackMulti(opts *Options, sourcefiles []string, output string) error {
+	tmp, err := ioutil.TempDir("", "gorun-pack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return err
+	}
+	mod := &packedModule{require: map[string]string{}, replace: map[string]string{}, sums: map[string]bool{}}
+	names := map[string]string{}
+	var env []string
+	for i, sourcefile := range sourcefiles {
+		content, err := ioutil.ReadFile(sourcefile)
+		if os.IsNotExist(err) {
+			return &exitError{ExitNotFound, err}
+		}
+		if err != nil {
+			return err
+		}
+		content = bytes.TrimPrefix(content, utf8BOM)
+		name := strings.TrimSuffix(filepath.Base(sourcefile), ".go")
+		if _, ok := names[name]; ok {
+			return errors.New("two scripts are named " + name)
+		}
+		pkg := "cmd" + strconv.Itoa(i)
+		names[name] = pkg
+
+		source, err := packageSource(sourcefile, content, pkg)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(tmp, pkg)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".go"), source, 0600); err != nil {
+			return err
+		}
+		if err := mod.add(gotool, tmp, sourcefile, content); err != nil {
+			return errors.New(sourcefile + ": " + err.Error())
+		}
+		env = append(env, ExpandGoEnv(gorun.Section(content, "go.env"))...)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "go.mod"), mod.goMod(), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "go.sum"), mod.goSum(), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "main.go"), dispatcher(names), 0600); err != nil {
+		return err
+	}
+
+	build, err := opts.BuildSettings(sourcefiles[0], nil)
+	if err != nil {
+		return err
+	}
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	env = append(append(append(os.Environ(), "GO111MODULE=on"), env...), build.Env...)
+	args := append([]string{gotool, "build", "-o", output}, build.Flags...)
+	if err := Exec(tmp, env, append(args, ".")); err != nil {
+		return &exitError{ExitCompile, err}
+	}
+	return nil
+}
+
+// packageSource returns the source of a script turned into the package
+// pkg, its main function being renamed to GorunMain.
+func packageSource(sourcefile string, content []byte, pkg string) ([]byte, error) {
+	content = gorun.GoSource(content)
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, sourcefile, content, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	f.Name.Name = pkg
+	found := false
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" {
+			fn.Name.Name = "GorunMain"
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New(sourcefile + ": no main function")
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dispatcher returns the main package of a multi-call binary running
+// the GorunMain function of the package names[name] as name.
+func dispatcher(names map[string]string) []byte {
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	var buf bytes.Buffer
+	buf.WriteString("package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\t\"path/filepath\"\n\n")
+	for _, name := range sorted {
+		buf.WriteString("\t" + names[name] + " " + strconv.Quote(packModule+"/"+names[name]) + "\n")
+	}
+	buf.WriteString(")\n\nvar commands = map[string]func(){\n")
+	for _, name := range sorted {
+		buf.WriteString("\t" + strconv.Quote(name) + ": " + names[name] + ".GorunMain,\n")
+	}
+	buf.WriteString(`}
+
+func main() {
+	name := filepath.Base(os.Args[0])
+	if main, ok := commands[name]; ok {
+		main()
+		return
+	}
+	if len(os.Args) > 1 {
+		if main, ok := commands[os.Args[1]]; ok {
+			os.Args = os.Args[1:]
+			main()
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: "+name+" <command> [...]")
+	fmt.Fprintln(os.Stderr, "commands:")
+`)
+	for _, name := range sorted {
+		buf.WriteString("\tfmt.Fprintln(os.Stderr, \"  " + name + "\")\n")
+	}
+	buf.WriteString("\tos.Exit(2)\n}\n")
+	return buf.Bytes()
+}
+
+// packedModule merges the go.mod and go.sum sections of several scripts.
+type packedModule struct {
+	goVersion string
+	require   map[string]string // module path to version
+	replace   map[string]string // replaced module to replacement
+	sums      map[string]bool   // go.sum lines
+}
+
+// add merges the go.mod and go.sum sections of the script sourcefile
+// with content into mod, using dir as a scratch directory.
+func (mod *packedModule) add(gotool, dir, sourcefile string, content []byte) error {
+	for _, line := range strings.Split(string(gorun.Section(content, "go.sum")), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			mod.sums[line] = true
+		}
+	}
+	section := gorun.Section(content, "go.mod")
+	if len(section) == 0 {
+		return nil
+	}
+	modFile := filepath.Join(dir, "script.mod")
+	if err := ioutil.WriteFile(modFile, section, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(modFile)
+	out, err := exec.Command(gotool, "mod", "edit", "-json", modFile).Output()
+	if err != nil {
+		return errors.New("bad go.mod section: " + err.Error())
+	}
+	type version struct{ Path, Version string }
+	var parsed struct {
+		Go      string
+		Require []version
+		Replace []struct{ Old, New version }
+	}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return err
+	}
+	if versionLess(mod.goVersion, parsed.Go) {
+		mod.goVersion = parsed.Go
+	}
+	for _, req := range parsed.Require {
+		if versionLess(mod.require[req.Path], req.Version) {
+			mod.require[req.Path] = req.Version
+		}
+	}
+	for _, rep := range parsed.Replace {
+		old := strings.TrimSpace(rep.Old.Path + " " + rep.Old.Version)
+		replacement := rep.New.Path
+		if rep.New.Version != "" {
+			replacement += " " + rep.New.Version
+		} else if !filepath.IsAbs(replacement) {
+			// A directory, relative to the script.
+			scriptDir, err := filepath.Abs(filepath.Dir(sourcefile))
+			if err != nil {
+				return err
+			}
+			replacement = filepath.Join(scriptDir, replacement)
+		}
+		mod.replace[old] = replacement
+	}
+	return nil
+}
+
+func (mod *packedModule) goMod() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("module " + packModule + "\n")
+	if mod.goVersion != "" {
+		buf.WriteString("\ngo " + mod.goVersion + "\n")
+	}
+	for _, path := range sortedKeys(mod.require) {
+		buf.WriteString("\nrequire " + path + " " + mod.require[path] + "\n")
+	}
+	for _, old := range sortedKeys(mod.replace) {
+		buf.WriteString("\nreplace " + old + " => " + mod.replace[old] + "\n")
+	}
+	return buf.Bytes()
+}
+
+func (mod *packedModule) goSum() []byte {
+	var lines []string
+	for line := range mod.sums {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// versionLess reports whether the module or Go version a is lower than
+// b, an empty version being lower than any other.  Pre-release versions
+// are ordered by their suffix, which holds for pseudo-versions.
+func versionLess(a, b string) bool {
+	if a == "" || b == "" {
+		return a == "" && b != ""
+	}
+	splitVersion := func(v string) ([]int, string) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexByte(v, '+'); i >= 0 {
+			v = v[:i]
+		}
+		pre := ""
+		if i := strings.IndexByte(v, '-'); i >= 0 {
+			v, pre = v[:i], v[i:]
+		}
+		var nums []int
+		for _, part := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(part)
+			nums = append(nums, n)
+		}
+		return nums, pre
+	}
+	an, apre := splitVersion(a)
+	bn, bpre := splitVersion(b)
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	if apre == "" || bpre == "" {
+		return apre != "" && bpre == ""
+	}
+	return apre < bpre
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// PickEntry is a script offered by the picker.
+type PickEntry struct {
+	Path    string
+	Name    string
+	Summary string
+}
+
+// pickHeight is the number of scripts the picker shows at once.
+const pickHeight = 10
+
+// PickEntries returns the scripts in dir, with the first line of their
+// usage section as summary.
+func PickEntries(dir string) ([]PickEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []PickEntry
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		entry := PickEntry{Path: path, Name: filepath.Base(path)}
+		if scan, err := scanScript(path); err == nil {
+			usage := strings.TrimSpace(string(ScriptUsage(scan.header)))
+			if i := strings.Index(usage, "\n"); i >= 0 {
+				usage = usage[:i]
+			}
+			entry.Summary = usage
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no scripts in " + dir)
+	}
+	return entries, nil
+}
+
+// fuzzyScore returns how well query matches text, its characters
+// appearing in order but not necessarily next to each other: the length
+// of the shortest span of text holding them, or -1 if there's none.
+func fuzzyScore(query, text string) int {
+	query, text = strings.ToLower(query), strings.ToLower(text)
+	if query == "" {
+		return 0
+	}
+	best := -1
+	for start := 0; start < len(text); start++ {
+		if !strings.HasPrefix(text[start:], query[:1]) {
+			continue
+		}
+		i, j := start, 0
+		for i < len(text) && j < len(query) {
+			if text[i] == query[j] {
+				j++
+			}
+			i++
+		}
+		if j < len(query) {
+			break
+		}
+		if span := i - start; best < 0 || span < best {
+			best = span
+		}
+	}
+	return best
+}
+
+// filterEntries returns the entries matching query, the best matches
+// first.  Matches on the name of the scripts rank before matches on
+// their summary only.
+func filterEntries(entries []PickEntry, query string) []PickEntry {
+	type match struct {
+		entry PickEntry
+		score int
+	}
+	var matches []match
+	for _, entry := range entries {
+		score := fuzzyScore(query, entry.Name)
+		if score < 0 {
+			if score = fuzzyScore(query, entry.Summary); score < 0 {
+				continue
+			}
+			score += 1 << 16
+		}
+		matches = append(matches, match{entry, score})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score < matches[j].score })
+	filtered := make([]PickEntry, len(matches))
+	for i, m := range matches {
+		filtered[i] = m.entry
+	}
+	return filtered
+}
+
+// Pick lets the user choose one of entries on the terminal, narrowing
+// them down by typing part of their name or summary, and returns the
+// path of the chosen script, or "" if the user gave up.
+func Pick(entries []PickEntry) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("picking a script needs a terminal: " + err.Error())
+	}
+	defer tty.Close()
+	restore, err := ttyMode(tty, "-g")
+	if err != nil {
+		return "", err
+	}
+	if _, err := ttyMode(tty, "-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return "", err
+	}
+	defer ttyMode(tty, strings.TrimSpace(restore))
+
+	var query []byte
+	selected := 0
+	drawn := 0
+	in := bufio.NewReader(tty)
+	for {
+		filtered := filterEntries(entries, string(query))
+		if selected >= len(filtered) {
+			selected = len(filtered) - 1
+		}
+		if selected < 0 {
+			selected = 0
+		}
+		drawn = drawPicker(tty, drawn, string(query), filtered, selected)
+
+		b, err := in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '\r', '\n':
+			clearPicker(tty, drawn)
+			if len(filtered) == 0 {
+				return "", nil
+			}
+			return filtered[selected].Path, nil
+		case 3, 4: // Ctrl-C, Ctrl-D
+			clearPicker(tty, drawn)
+			return "", nil
+		case 127, 8: // Backspace
+			if len(query) > 0 {
+				_, size := utf8.DecodeLastRune(query)
+				query = query[:len(query)-size]
+			}
+		case 16: // Ctrl-P
+			selected--
+		case 14: // Ctrl-N
+			selected++
+		case 27: // Escape, or an arrow key
+			if in.Buffered() == 0 {
+				clearPicker(tty, drawn)
+				return "", nil
+			}
+			seq := make([]byte, 2)
+			if _, err := in.Read(seq); err == nil && seq[0] == '[' {
+				switch seq[1] {
+				case 'A':
+					selected--
+				case 'B':
+					selected++
+				}
+			}
+		default:
+			if b >= ' ' {
+				query = append(query, b)
+			}
+		}
+	}
+}
+
+// drawPicker draws the picker from the prompt line, where the cursor
+// is left, over the drawn lines below it drawn before, and returns how
+// many lines it drew below the prompt.
+func drawPicker(tty *os.File, drawn int, query string, entries []PickEntry, selected int) int {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "\r\x1b[K> %s", query)
+	first := 0
+	if selected >= pickHeight {
+		first = selected - pickHeight + 1
+	}
+	lines := 0
+	for i := first; i < len(entries) && i < first+pickHeight; i++ {
+		line := entries[i].Name
+		if entries[i].Summary != "" {
+			line += "  \x1b[2m" + entries[i].Summary + "\x1b[22m"
+		}
+		if i == selected {
+			line = "\x1b[7m" + line + "\x1b[27m"
+		}
+		fmt.Fprintf(&out, "\n\r\x1b[K  %s", line)
+		lines++
+	}
+	// Clear what's left of a longer list.
+	down := lines
+	for ; down < drawn; down++ {
+		out.WriteString("\n\r\x1b[K")
+	}
+	if down > 0 {
+		fmt.Fprintf(&out, "\x1b[%dA", down)
+	}
+	fmt.Fprintf(&out, "\r\x1b[%dC", len(query)+2)
+	tty.Write(out.Bytes())
+	return lines
+}
+
+// clearPicker erases the prompt line and the drawn lines below it.
+func clearPicker(tty *os.File, drawn int) {
+	var out bytes.Buffer
+	out.WriteString("\r\x1b[K")
+	for i := 0; i < drawn; i++ {
+		out.WriteString("\n\x1b[K")
+	}
+	if drawn > 0 {
+		fmt.Fprintf(&out, "\x1b[%dA", drawn)
+	}
+	tty.Write(out.Bytes())
+}
+
+// ttyMode runs stty with args on tty and returns its output.
+func ttyMode(tty *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("stty failed: " + err.Error())
+	}
+	return string(out), nil
+}
+
+// RunPicked lets the user pick one of the scripts in dir and runs it
+// with arguments args.
+func RunPicked(opts *Options, dir string, args []string) error {
+	entries, err := PickEntries(dir)
+	if err != nil {
+		return err
+	}
+	path, err := Pick(entries)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		return &exitError{ExitFailure, nil}
+	}
+	return Run(opts, append([]string{path}, args...))
+}
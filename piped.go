@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// IsPiped reports whether sourcefile isn't a regular file but, say, a
+// FIFO or the pipe of a process substitution such as <(generate-script),
+// which can only be read once.
+func IsPiped(sourcefile string) bool {
+	stat, err := os.Stat(sourcefile)
+	return err == nil && !stat.Mode().IsRegular() && !stat.IsDir()
+}
+
+// RunPiped reads the script args[0], which IsPiped or is "-" for stdin,
+// and runs it with arguments args[1:].  The script is saved into the
+// cache under a name derived from its content, so that the same script
+// piped again doesn't need to be rebuilt.
+func RunPiped(opts *Options, args []string) error {
+	safe, err := SafeSourceRequired()
+	if err != nil {
+		return err
+	}
+	var content []byte
+	if args[0] == "-" {
+		// The script then finds its stdin at its end.
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		// Anonymous pipes, unlike FIFOs, have no path to check.
+		if path, err := filepath.Abs(args[0]); safe && err == nil {
+			if _, err := filepath.EvalSymlinks(path); err == nil {
+				if err := CheckSafeSource(args[0]); err != nil {
+					return err
+				}
+			}
+		}
+		content, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	// The script run is a copy, so check what was read from the pipe.
+	if opts.VerifyManifest {
+		if args[0] == "-" {
+			return errors.New("refusing to run the script on stdin: it can't be verified against a manifest")
+		}
+		if err := VerifyContent(args[0], content); err != nil {
+			return err
+		}
+		verified := *opts
+		verified.VerifyManifest = false
+		opts = &verified
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	sourcefile, err := materialize(auxDir(runBaseDir, "piped"), hex.EncodeToString(sum[:8])+".go", content)
+	if err != nil {
+		return err
+	}
+	return Run(opts, append([]string{sourcefile}, args[1:]...))
+}
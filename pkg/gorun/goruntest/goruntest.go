@@ -0,0 +1,114 @@
+// Package goruntest helps writing hermetic tests of programs building
+// and running scripts with package gorun: runners caching into a
+// temporary directory, a fake toolchain not running go, and scripts
+// written in the test itself.
+package goruntest
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// NewRunner returns a Runner with the settings in opts, caching into a
+// new temporary directory whatever opts.CacheDir says, and the function
+// removing that directory, to be deferred.  The test fails if the
+// Runner can't be made.
+func NewRunner(tb testing.TB, opts gorun.Options) (*gorun.Runner, func()) {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "goruntest-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	opts.CacheDir = dir
+	r, err := gorun.NewRunner(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+// FakeToolchain is a gorun.Toolchain that doesn't run go: it records
+// the scripts it's asked to build, and "builds" them by copying Binary,
+// or fails with Err.
+type FakeToolchain struct {
+	// Binary is the program standing for the scripts built, such as
+	// the test binary itself, os.Args[0], with a TestMain acting as
+	// the scripts would when an environment variable is set.
+	Binary string
+	// Err, if set, makes the builds fail, with Output as what the
+	// toolchain printed.
+	Err    error
+	Output []byte
+
+	mu      sync.Mutex
+	sources [][]byte
+}
+
+// Version returns "fake".
+func (f *FakeToolchain) Version() (string, error) {
+	return "fake", nil
+}
+
+// Build records the script in dir, then copies f.Binary to output, or
+// fails with f.Err.
+func (f *FakeToolchain) Build(dir, output string, flags, env []string) ([]byte, error) {
+	source, err := ioutil.ReadFile(filepath.Join(dir, "main.go"))
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.sources = append(f.sources, source)
+	f.mu.Unlock()
+	if f.Err != nil {
+		return f.Output, f.Err
+	}
+	in, err := os.Open(f.Binary)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return f.Output, out.Close()
+}
+
+// Sources returns the scripts f was asked to build so far, as they were
+// given to the toolchain, in order.
+func (f *FakeToolchain) Sources() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.sources...)
+}
+
+// Script returns the source of a script importing imports, whose main
+// function has body, as in
+//
+//	goruntest.Script(`fmt.Println(strings.ToUpper(os.Args[1]))`, "fmt", "os", "strings")
+func Script(body string, imports ...string) []byte {
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	if len(imports) > 0 {
+		b.WriteString("import (\n")
+		for _, path := range imports {
+			b.WriteString("\t" + strconv.Quote(path) + "\n")
+		}
+		b.WriteString(")\n\n")
+	}
+	b.WriteString("func main() {\n" + body + "\n}\n")
+	return []byte(b.String())
+}
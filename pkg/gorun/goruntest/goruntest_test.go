@@ -0,0 +1,70 @@
+package goruntest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// TestMain acts as the scripts built by FakeToolchain, the test binary
+// standing for them.
+func TestMain(m *testing.M) {
+	if os.Getenv("GORUNTEST_SCRIPT") == "1" {
+		fmt.Println(strings.Join(os.Args[1:], " "))
+		os.Exit(3)
+	}
+	os.Exit(m.Run())
+}
+
+func TestFakeToolchain(t *testing.T) {
+	toolchain := &FakeToolchain{Binary: os.Args[0]}
+	var stdout bytes.Buffer
+	r, cleanup := NewRunner(t, gorun.Options{
+		Toolchain: toolchain,
+		Env:       append(os.Environ(), "GORUNTEST_SCRIPT=1"),
+		Stdout:    &stdout,
+	})
+	defer cleanup()
+
+	script := Script(`fmt.Println(os.Args[1:])`, "fmt", "os")
+	for i, cached := range []bool{false, true} {
+		stdout.Reset()
+		result, err := r.Run(script, "hello", "world")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ExitCode != 3 || result.Cached != cached || stdout.String() != "hello world\n" {
+			t.Errorf("run %d: got exit code %d, cached %v and output %q", i+1, result.ExitCode, result.Cached, stdout.String())
+		}
+	}
+	if sources := toolchain.Sources(); len(sources) != 1 || !bytes.Equal(sources[0], script) {
+		t.Errorf("got sources %q, want the script built once", sources)
+	}
+
+	toolchain.Err, toolchain.Output = errors.New("exit status 1"), []byte("undefined: x")
+	_, err := r.Run(Script(`x()`))
+	if buildErr, ok := err.(*gorun.BuildError); !ok || string(buildErr.Output) != "undefined: x" {
+		t.Errorf("got %v, want a build error", err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	tests := []struct {
+		body    string
+		imports []string
+		source  string
+	}{
+		{`println()`, nil, "package main\n\nfunc main() {\nprintln()\n}\n"},
+		{`fmt.Println()`, []string{"fmt"}, "package main\n\nimport (\n\t\"fmt\"\n)\n\nfunc main() {\nfmt.Println()\n}\n"},
+	}
+	for _, test := range tests {
+		if source := string(Script(test.body, test.imports...)); source != test.source {
+			t.Errorf("Script(%q, %q) = %q, want %q", test.body, test.imports, source, test.source)
+		}
+	}
+}
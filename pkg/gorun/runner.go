@@ -0,0 +1,264 @@
+package gorun
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Options holds the settings of a Runner.
+type Options struct {
+	// CacheDir is where binaries are cached, by default gorun/runner
+	// in the user's cache directory.
+	CacheDir string
+	// GoTool is the go command building scripts, by default the one
+	// GoTool finds.
+	GoTool string
+	// Toolchain builds the scripts, by default with GoTool.  Tests can
+	// replace it with a fake one.
+	Toolchain Toolchain
+	// BuildFlags holds additional go build flags.
+	BuildFlags []string
+	// BuildEnv holds additional environment variables for go build.
+	BuildEnv []string
+
+	// Dir, Env, Stdin, Stdout and Stderr are those of the scripts run,
+	// as with exec.Cmd: by default they run in the current directory,
+	// with the environment of the program, and without input or output.
+	Dir    string
+	Env    []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Result describes a script run.
+type Result struct {
+	// ExitCode is the exit status of the script, -1 if it was killed
+	// by a signal.
+	ExitCode int
+	// Binary is the path of the cached binary that was run.
+	Binary string
+	// Cached tells whether the binary was cached already.
+	Cached bool
+	// BuildTime and RunTime are how long the script took to build,
+	// or to be found in the cache, and to run.
+	BuildTime time.Duration
+	RunTime   time.Duration
+}
+
+// BuildError is returned when a script fails to build.
+type BuildError struct {
+	// Output holds what go build printed.
+	Output []byte
+	Err    error
+}
+
+func (e *BuildError) Error() string {
+	return "can't build script: " + e.Err.Error() + "\n" + string(e.Output)
+}
+
+// Toolchain builds scripts.
+type Toolchain interface {
+	// Version identifies the toolchain, the binaries it builds being
+	// cached apart from those of other versions.
+	Version() (string, error)
+	// Build builds the module in dir, holding the script as main.go
+	// along with its go.mod and go.sum, into the binary output with
+	// the given go build flags and environment.  It returns what it
+	// printed.
+	Build(dir, output string, flags, env []string) ([]byte, error)
+}
+
+// goToolchain is the Toolchain running the go command at its path.
+type goToolchain string
+
+func (gotool goToolchain) Version() (string, error) {
+	out, err := exec.Command(string(gotool), "version").Output()
+	if err != nil {
+		return "", errors.New("can't get the version of " + string(gotool) + ": " + err.Error())
+	}
+	return string(gotool) + " " + string(bytes.TrimSpace(out)), nil
+}
+
+func (gotool goToolchain) Build(dir, output string, flags, env []string) ([]byte, error) {
+	cmd := exec.Command(string(gotool), append(append([]string{"build", "-o", output}, flags...), ".")...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.CombinedOutput()
+}
+
+// Runner builds and runs scripts, caching their binaries.  It's safe
+// for concurrent use, including by several processes sharing a cache.
+type Runner struct {
+	opts Options
+
+	versionOnce sync.Once
+	version     string
+	versionErr  error
+}
+
+// NewRunner returns a Runner with the settings in opts.
+func NewRunner(opts Options) (*Runner, error) {
+	if opts.CacheDir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		opts.CacheDir = filepath.Join(cacheDir, "gorun", "runner")
+	}
+	if opts.Toolchain == nil {
+		if opts.GoTool == "" {
+			gotool, err := GoTool()
+			if err != nil {
+				return nil, err
+			}
+			opts.GoTool = gotool
+		}
+		opts.Toolchain = goToolchain(opts.GoTool)
+	}
+	return &Runner{opts: opts}, nil
+}
+
+// GoTool returns the go command of the Go installation gorun was built
+// with, or else the one in PATH.
+func GoTool() (string, error) {
+	gotool := filepath.Join(runtime.GOROOT(), "bin", "go")
+
+	if _, err := os.Stat(gotool); err != nil {
+		if gotool, err = exec.LookPath("go"); err != nil {
+			return "", errors.New("can't find go tool")
+		}
+	}
+	return gotool, nil
+}
+
+// toolchainVersion returns the version of the toolchain, asked once.
+func (r *Runner) toolchainVersion() (string, error) {
+	r.versionOnce.Do(func() {
+		r.version, r.versionErr = r.opts.Toolchain.Version()
+	})
+	return r.version, r.versionErr
+}
+
+// exeSuffix is the suffix of executable files.
+func exeSuffix() string {
+	if runtime.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+// Build compiles the script source, unless it was already, and returns
+// the path of its cached binary, telling whether it was cached.  The
+// script may embed its go.mod and go.sum in sections, as in
+//
+//	// go.mod >>>
+//	// module script
+//	// require github.com/google/uuid v1.6.0
+//	// <<< go.mod
+//
+// and is built as a module of its own otherwise.
+func (r *Runner) Build(source []byte) (binary string, cached bool, err error) {
+	version, err := r.toolchainVersion()
+	if err != nil {
+		return "", false, err
+	}
+	h := sha256.New()
+	for _, part := range [][]string{{version}, r.opts.BuildFlags, r.opts.BuildEnv} {
+		for _, s := range part {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{0})
+	}
+	h.Write(source)
+	dir := filepath.Join(r.opts.CacheDir, hex.EncodeToString(h.Sum(nil))[:32])
+	binary = filepath.Join(dir, "script"+exeSuffix())
+	if stat, err := os.Stat(binary); err == nil && stat.Mode().IsRegular() {
+		return binary, true, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", false, err
+	}
+	// Concurrent builds of the same script each have their own
+	// directory, the last one to finish replacing the binary.
+	tmp, err := ioutil.TempDir(dir, "build-")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.RemoveAll(tmp)
+	mod := Section(source, "go.mod")
+	if len(mod) == 0 {
+		mod = []byte("module script\n")
+	}
+	files := map[string][]byte{"main.go": GoSource(source), "go.mod": mod}
+	if sum := Section(source, "go.sum"); len(sum) > 0 {
+		files["go.sum"] = sum
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), content, 0600); err != nil {
+			return "", false, err
+		}
+	}
+	bin := filepath.Join(tmp, "script"+exeSuffix())
+	if out, err := r.opts.Toolchain.Build(tmp, bin, r.opts.BuildFlags, r.opts.BuildEnv); err != nil {
+		return "", false, &BuildError{out, err}
+	}
+	if err := os.Rename(bin, binary); err != nil {
+		return "", false, err
+	}
+	return binary, false, nil
+}
+
+// Run builds the script source as Build does, and runs it with args.
+// The exit status of the script is in the Result; an error means that
+// the script couldn't be built or started.
+func (r *Runner) Run(source []byte, args ...string) (*Result, error) {
+	start := time.Now()
+	binary, cached, err := r.Build(source)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Binary: binary, Cached: cached, BuildTime: time.Since(start)}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = r.opts.Dir
+	cmd.Env = r.opts.Env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r.opts.Stdin, r.opts.Stdout, r.opts.Stderr
+	start = time.Now()
+	err = cmd.Run()
+	result.RunTime = time.Since(start)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RunFile runs the script in the file sourcefile with args, as Run does.
+func (r *Runner) RunFile(sourcefile string, args ...string) (*Result, error) {
+	source, err := ioutil.ReadFile(sourcefile)
+	if err != nil {
+		return nil, err
+	}
+	return r.Run(source, args...)
+}
+
+// Clean removes the binaries cached by r.
+func (r *Runner) Clean() error {
+	return os.RemoveAll(r.opts.CacheDir)
+}
@@ -0,0 +1,75 @@
+package gorun
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSection(t *testing.T) {
+	tests := []struct {
+		content, name, section string
+	}{
+		{"package main\n", "go.mod", ""},
+		{"// go.mod >>>\n// module x\n// <<< go.mod\n", "go.mod", "\nmodule x\n"},
+		{"// go.mod >>>\r\n// module x\r\n// <<< go.mod\r\n", "go.mod", "\nmodule x\n"},
+		{"// go.mod >>>\n//module x\n//\n// <<< go.mod\n", "go.mod", "\nmodule x\n\n"},
+		{"// go.mod >>>\n// module x\n", "go.mod", ""},
+		{"// <<< go.mod\n// go.mod >>>\n", "go.mod", ""},
+		{"// go.sum >>>\n// a\n// <<< go.sum\n", "go.mod", ""},
+	}
+	for _, test := range tests {
+		if section := string(Section([]byte(test.content), test.name)); section != test.section {
+			t.Errorf("Section(%q, %q) = %q, want %q", test.content, test.name, section, test.section)
+		}
+	}
+}
+
+func TestGoSource(t *testing.T) {
+	tests := []struct {
+		content, source string
+	}{
+		{"package main\n", "package main\n"},
+		{"#!/usr/bin/env gorun\npackage main\n", "///usr/bin/env gorun\npackage main\n"},
+		{"#!/bin/sh\nexec gorun \"$0\"\n//gorun:header-end\npackage main\n", "\n\n\npackage main\n"},
+		{"package main\n//gorun:header-end\n", "package main\n//gorun:header-end\n"},
+	}
+	for _, test := range tests {
+		if source := string(GoSource([]byte(test.content))); source != test.source {
+			t.Errorf("GoSource(%q) = %q, want %q", test.content, source, test.source)
+		}
+	}
+}
+
+func TestRunner(t *testing.T) {
+	if _, err := GoTool(); err != nil {
+		t.Skip(err)
+	}
+	cache, err := ioutil.TempDir("", "gorun-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	var stdout bytes.Buffer
+	r, err := NewRunner(Options{CacheDir: cache, Stdout: &stdout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := []byte("#!/usr/bin/env gorun\npackage main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n\tfmt.Println(os.Args[1])\n\tos.Exit(3)\n}\n")
+	for i, cached := range []bool{false, true} {
+		stdout.Reset()
+		result, err := r.Run(script, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ExitCode != 3 || result.Cached != cached || stdout.String() != "hello\n" {
+			t.Errorf("run %d: got exit code %d, cached %v and output %q", i+1, result.ExitCode, result.Cached, stdout.String())
+		}
+	}
+
+	_, err = r.Run([]byte("package main\n\nfunc main() { undefined() }\n"))
+	if buildErr, ok := err.(*BuildError); !ok || !bytes.Contains(buildErr.Output, []byte("undefined")) {
+		t.Errorf("got %v, want a build error", err)
+	}
+}
@@ -0,0 +1,62 @@
+// Package gorun compiles and runs Go scripts, single Go files possibly
+// embedding their go.mod and go.sum, caching their binaries, for
+// programs running Go snippets without shelling out to the gorun
+// command.
+//
+// Runner is a minimal runner of its own, not the one of the command:
+// the command only shares the parsing of scripts with it, that is
+// Section, GoSource, GoTool and HeaderEnd, and builds scripts its own
+// way, with the pragmas, includes, go.env sections, cache eviction and
+// everything else Runner lacks.
+package gorun
+
+import (
+	"bytes"
+	"strings"
+)
+
+// HeaderEnd ends the shell preamble of polyglot scripts, which can run
+// as shell scripts too, for instance to install gorun before running
+// themselves with it.
+const HeaderEnd = "//gorun:header-end"
+
+// GoSource returns content, a script, as Go source: with its bang line
+// turned into a comment and the lines of its polyglot header, if any,
+// blanked, so that line numbers are kept.
+func GoSource(content []byte) []byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	for i, line := range lines {
+		trimmed := bytes.TrimSpace(line)
+		if string(trimmed) == HeaderEnd {
+			out := bytes.Repeat([]byte("\n"), i+1)
+			return append(out, bytes.Join(lines[i+1:], nil)...)
+		}
+		if bytes.HasPrefix(trimmed, []byte("package ")) {
+			break
+		}
+	}
+	if bytes.HasPrefix(content, []byte("#!")) {
+		return append([]byte("//"), content[2:]...)
+	}
+	return content
+}
+
+// Section returns the contents of the section called name embedded in
+// the comments of content, between "// name >>>" and "// <<< name",
+// without the comment markers, or an empty slice if there's none.
+func Section(content []byte, name string) []byte {
+	start := "// " + name + " >>>"
+	end := "// <<< " + name
+	startIdx := bytes.Index(content, []byte(start))
+	if startIdx >= 0 {
+		idxEnd := bytes.Index(content, []byte(end))
+		if idxEnd > startIdx {
+			section := string(content[startIdx+len(start) : idxEnd])
+			section = strings.ReplaceAll(section, "\r\n", "\n")
+			section = strings.ReplaceAll(section, "\n// ", "\n")
+			section = strings.ReplaceAll(section, "\n//", "\n")
+			return []byte(section)
+		}
+	}
+	return []byte("")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// Pragma is a "//gorun:name args..." line in a script, giving gorun
+// per-script settings that would otherwise be command line flags.
+type Pragma struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+}
+
+const pragmaPrefix = "//gorun:"
+
+// Pragmas returns the gorun pragmas found in content, in order.
+func Pragmas(content []byte) []Pragma {
+	// The polyglot header is shell.
+	content = gorun.GoSource(content)
+	var pragmas []Pragma
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, pragmaPrefix) {
+			continue
+		}
+		fields := strings.Fields(line[len(pragmaPrefix):])
+		if len(fields) == 0 {
+			continue
+		}
+		pragmas = append(pragmas, Pragma{Name: fields[0], Args: fields[1:]})
+	}
+	return pragmas
+}
+
+// pragmaValue returns the argument of the last pragma called name in
+// pragmas, or "" if there's none.
+func pragmaValue(pragmas []Pragma, name string) string {
+	value := ""
+	for _, pragma := range pragmas {
+		if pragma.Name == name {
+			value = strings.Join(pragma.Args, " ")
+		}
+	}
+	return value
+}
+
+// hasPragma reports whether pragmas include one called name.
+func hasPragma(pragmas []Pragma, name string) bool {
+	for _, pragma := range pragmas {
+		if pragma.Name == name {
+			return true
+		}
+	}
+	return false
+}
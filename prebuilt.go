@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// DefaultSystemCache is where packages install the prebuilt binaries of
+// the scripts they ship, laid out like the per-user cache.
+const DefaultSystemCache = "/usr/lib/gorun/cache"
+
+// SystemCacheDir returns the read-only system cache directory for the
+// current platform, or "" if it's disabled.  GORUN_SYSTEM_CACHE selects
+// another location, or disables it when set to "off".
+func SystemCacheDir() string {
+	dir := os.Getenv("GORUN_SYSTEM_CACHE")
+	switch dir {
+	case "":
+		dir = DefaultSystemCache
+	case "off":
+		return ""
+	}
+	return filepath.Join(dir, runtime.GOOS+"_"+runtime.GOARCH)
+}
+
+// SharedCacheDir returns the directory of the cache shared by the users
+// of a machine for the current platform, or "" if there's none.  It's
+// only used when GORUN_SHARED_CACHE gives its location.
+func SharedCacheDir() string {
+	dir := os.Getenv("GORUN_SHARED_CACHE")
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, runtime.GOOS+"_"+runtime.GOARCH)
+}
+
+var (
+	errSystemCacheOff = errors.New("the system cache is disabled by GORUN_SYSTEM_CACHE")
+	errNoSharedCache  = errors.New("no shared cache, set GORUN_SHARED_CACHE")
+)
+
+// prebuiltRunFile returns the path of the binary built from sourcefile
+// with the settings identified by key in the cache directory dir.
+func prebuiltRunFile(dir, sourcefile string, key []string) (string, error) {
+	entry, baseFileName, err := cacheEntryName(sourcefile)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, entry, baseFileName+keySuffix(key)+".gorun"+exeSuffix), nil
+}
+
+// SystemBinary returns the path of a prebuilt binary for sourcefile in
+// the system cache, or "" if there's none that can be trusted: it must
+// have been built from sources whose digest is sum, as returned by
+// SourceHash, be owned by root or the current user, writable by no one
+// else, and match its recorded hash unless verify is VerifyOff.
+func SystemBinary(sourcefile string, key []string, sum, verify string) string {
+	dir := SystemCacheDir()
+	if dir == "" {
+		return ""
+	}
+	runFile, err := prebuiltRunFile(dir, sourcefile, key)
+	if err != nil {
+		return ""
+	}
+	rstat, err := os.Stat(runFile)
+	if err != nil {
+		return ""
+	}
+	uid := sysStat(rstat).Uid
+	if uid != 0 && uid != uint32(os.Geteuid()) || !trustedBinary(rstat) {
+		return ""
+	}
+	if meta, err := ReadMeta(runFile); err != nil || meta["source.sha256"] != sum {
+		return ""
+	}
+	if verify != VerifyOff && VerifyBinary(runFile) != nil {
+		return ""
+	}
+	return runFile
+}
+
+// SharedBinary returns the path of a binary for sourcefile in the shared
+// cache, or "" if there's none that can be trusted: it must be owned by
+// the owner of the shared cache, who builds for everyone, be writable by
+// no one else, match its recorded hash, and have been built from sources
+// whose digest is sum, as returned by SourceHash.
+func SharedBinary(sourcefile string, key []string, sum string) string {
+	dir := SharedCacheDir()
+	if dir == "" {
+		return ""
+	}
+	owner, ok := sharedCacheOwner(dir)
+	if !ok {
+		return ""
+	}
+	runFile, err := prebuiltRunFile(dir, sourcefile, key)
+	if err != nil {
+		return ""
+	}
+	rstat, err := os.Stat(runFile)
+	if err != nil || sysStat(rstat).Uid != owner || !trustedBinary(rstat) {
+		return ""
+	}
+	if meta, err := ReadMeta(runFile); err != nil || meta["source.sha256"] != sum {
+		return ""
+	}
+	if VerifyBinary(runFile) != nil {
+		return ""
+	}
+	return runFile
+}
+
+// sharedCacheOwner returns the owner of the shared cache directory dir,
+// provided no one else can write to it.
+func sharedCacheOwner(dir string) (uint32, bool) {
+	stat, err := os.Stat(dir)
+	if err != nil || !stat.IsDir() || stat.Mode().Perm()&022 != 0 {
+		return 0, false
+	}
+	return sysStat(stat).Uid, true
+}
+
+// trustedBinary reports whether a prebuilt binary is an executable
+// regular file that only its owner can modify.
+func trustedBinary(stat os.FileInfo) bool {
+	return stat.Mode().IsRegular() && stat.Mode().Perm()&0111 != 0 && stat.Mode().Perm()&022 == 0
+}
+
+// InstallSystem builds sourcefile with the settings in opts and installs
+// the binary in the system cache, where it's run from by everyone
+// without compiling.
+func InstallSystem(opts *Options, sourcefile string) (string, error) {
+	dir := SystemCacheDir()
+	if dir == "" {
+		return "", errSystemCacheOff
+	}
+	return installPrebuilt(opts, dir, sourcefile)
+}
+
+// InstallShared builds sourcefile with the settings in opts and installs
+// the binary in the shared cache.  Only the owner of the shared cache
+// can do so.
+func InstallShared(opts *Options, sourcefile string) (string, error) {
+	dir := SharedCacheDir()
+	if dir == "" {
+		return "", errNoSharedCache
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if owner, ok := sharedCacheOwner(dir); !ok || owner != uint32(os.Geteuid()) {
+		return "", errors.New("the shared cache must be owned by the user building for it, and writable by no one else: " + dir)
+	}
+	return installPrebuilt(opts, dir, sourcefile)
+}
+
+// installPrebuilt builds sourcefile with the settings in opts and
+// installs the binary, readable by everyone, in the cache directory dir.
+func installPrebuilt(opts *Options, dir, sourcefile string) (string, error) {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return "", &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return "", err
+	}
+	sstat, err := os.Stat(sourcefile)
+	if err != nil {
+		return "", err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return "", err
+	}
+	if err := opts.PrepareSource(sourcefile, content, build); err != nil {
+		return "", err
+	}
+	runFile, err := prebuiltRunFile(dir, sourcefile, build.Key)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir("", "gorun-build-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	bin := filepath.Join(tmp, "bin")
+	if err := Compile(sourcefile, bin, tmp+string(filepath.Separator), build); err != nil {
+		return "", &exitError{ExitCompile, err}
+	}
+	sum, err := SourceHash(sourcefile, build.Includes)
+	if err != nil {
+		return "", err
+	}
+	if err := installBinary(bin, runFile, sum, sstat); err != nil {
+		return "", err
+	}
+	return runFile, nil
+}
+
+// installBinary copies the binary bin, along with its metadata, to
+// runFile in a cache shared with other users.  The digest sum of the
+// sources it was built from is added to the metadata for users to check
+// that the binary matches the script they run.
+func installBinary(bin, runFile, sum string, sstat os.FileInfo) error {
+	meta, err := ReadMeta(bin)
+	if err != nil {
+		return err
+	}
+	meta["source.sha256"] = sum
+	if err := os.MkdirAll(filepath.Dir(runFile), 0755); err != nil {
+		return err
+	}
+	if err := WriteMeta(runFile, meta); err != nil {
+		return err
+	}
+	if err := os.Chmod(MetaFile(runFile), 0644); err != nil {
+		return err
+	}
+	if err := copyFile(bin, runFile, 0755); err != nil {
+		return err
+	}
+	// Like in the per-user cache, the binary is as old as its source.
+	return os.Chtimes(runFile, sstat.ModTime(), sstat.ModTime())
+}
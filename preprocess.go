@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// Preprocess runs sourcefile through the commands of its
+// //gorun:preprocess pragmas in turn, each reading the source on stdin
+// and writing the transformed source on stdout, as in
+//
+//	//gorun:preprocess ./tools/expand-queries --dialect=postgres
+//
+// Commands containing a slash are relative to the directory of the
+// script, the others are looked up in PATH, and they run in the
+// directory of the script.  It returns the transformed source, or nil
+// if the script has no such pragma.
+func Preprocess(sourcefile string, pragmas []Pragma) ([]byte, error) {
+	var source []byte
+	for _, pragma := range pragmas {
+		if pragma.Name != "preprocess" {
+			continue
+		}
+		if len(pragma.Args) == 0 {
+			return nil, errors.New("usage: //gorun:preprocess <command> [arguments]")
+		}
+		if source == nil {
+			var err error
+			if source, err = ioutil.ReadFile(sourcefile); err != nil {
+				return nil, err
+			}
+		}
+		command := pragma.Args[0]
+		if strings.Contains(command, "/") && !filepath.IsAbs(command) {
+			var err error
+			if command, err = filepath.Abs(filepath.Join(filepath.Dir(sourcefile), command)); err != nil {
+				return nil, err
+			}
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(command, pragma.Args[1:]...)
+		cmd.Dir = filepath.Dir(sourcefile)
+		cmd.Stdin = bytes.NewReader(source)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			os.Stderr.Write(stderr.Bytes())
+			return nil, errors.New("preprocessor " + pragma.Args[0] + " failed: " + err.Error())
+		}
+		os.Stderr.Write(stderr.Bytes())
+		source = stdout.Bytes()
+	}
+	return source, nil
+}
+
+// RenderTemplate renders source, or sourcefile if source is nil, with
+// text/template.  The data is a map of the environment variables, as in
+// {{.API_URL}}, overridden by values, given as name=value.  Referring to
+// a missing value is an error.
+func RenderTemplate(sourcefile string, source []byte, values []string) ([]byte, error) {
+	if source == nil {
+		var err error
+		if source, err = ioutil.ReadFile(sourcefile); err != nil {
+			return nil, err
+		}
+	}
+	data := map[string]string{}
+	for _, value := range append(os.Environ(), values...) {
+		if i := strings.Index(value, "="); i > 0 {
+			data[value[:i]] = value[i+1:]
+		}
+	}
+	tmpl, err := template.New(filepath.Base(sourcefile)).Option("missingkey=error").Parse(string(source))
+	if err != nil {
+		return nil, errors.New("can't parse template: " + err.Error())
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, errors.New("can't render template: " + err.Error())
+	}
+	return rendered.Bytes(), nil
+}
+
+// writePreprocessed writes source, the output of the preprocessors or
+// the template of sourcefile, to dst, rewritten as writeRewritten does
+// with scripts.  Preprocessors can add their own line directives to
+// point errors at the lines of sourcefile they come from.
+func writePreprocessed(sourcefile, dst string, source []byte) error {
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return err
+	}
+	source = bytes.TrimPrefix(source, utf8BOM)
+	source = gorun.GoSource(source)
+	return ioutil.WriteFile(dst, append([]byte("//line "+path+":1:1\n"), source...), 0600)
+}
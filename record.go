@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Recording describes a run of a script recorded with --record, so that
+// it can be replayed with the same inputs.
+type Recording struct {
+	Script string    `json:"script"`
+	Args   []string  `json:"args"`
+	Dir    string    `json:"dir"`
+	Env    []string  `json:"env"`
+	SHA256 string    `json:"sha256"`
+	Stdin  bool      `json:"stdin"`
+	Time   time.Time `json:"time"`
+	// Options are the gorun settings the script ran with.
+	Options *Options `json:"options"`
+}
+
+// secretEnv matches the names of the environment variables that likely
+// hold secrets, which aren't recorded.
+var secretEnv = regexp.MustCompile(`(?i)token|secret|passw|credential|key|auth|cookie|session`)
+
+// publicEnv returns the variables of env, as os.Environ lists them, but
+// those secretEnv matches the names of.
+func publicEnv(env []string) []string {
+	var public []string
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 && !secretEnv.MatchString(kv[:i]) {
+			public = append(public, kv)
+		}
+	}
+	return public
+}
+
+// RecordingPath returns the directory of the recording called name: name
+// itself if it's a path, or else a directory kept along with the tracked
+// scripts, above the cache.
+func RecordingPath(name string) (string, error) {
+	if strings.ContainsRune(name, filepath.Separator) {
+		return name, nil
+	}
+	if name == "" || name == "." || name == ".." {
+		return "", errors.New("invalid recording name: " + name)
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(runBaseDir), "recordings", name), nil
+}
+
+// writeRecording records running runFile, the binary of the script
+// args[0], with arguments args[1:] and settings opts as opts.Record.
+// Unless it's a terminal, the standard input is read in full into the
+// recording, which the script then reads from instead.
+func writeRecording(opts *Options, runFile string, args []string) error {
+	dir, err := RecordingPath(opts.Record)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	script, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	recording := &Recording{Script: script, Args: args[1:], Dir: cwd, Env: publicEnv(os.Environ()),
+		Time: time.Now(), Options: opts}
+	if meta, err := ReadMeta(runFile); err == nil && meta["sha256"] != "" {
+		recording.SHA256 = meta["sha256"]
+	} else if recording.SHA256, err = FileHash(runFile); err != nil {
+		return err
+	}
+
+	stdin := filepath.Join(dir, "stdin")
+	if !isTerminal(os.Stdin) {
+		recording.Stdin = true
+		// Attempting to run the binary again reads the same input.
+		if !opts.recordedStdin {
+			if err := captureStdin(stdin); err != nil {
+				return err
+			}
+			opts.recordedStdin = true
+		}
+	} else {
+		os.Remove(stdin)
+	}
+
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "run.json"), append(data, '\n'), 0600)
+}
+
+// captureStdin copies the standard input to the file path, and makes it
+// the standard input.
+func captureStdin(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		return errors.New("can't record the standard input: " + err.Error())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return dupStdin(f)
+}
+
+// ReadRecording reads the recording called name.
+func ReadRecording(name string) (*Recording, error) {
+	dir, err := RecordingPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "run.json"))
+	if os.IsNotExist(err) {
+		return nil, errors.New("no recording called " + name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	recording := new(Recording)
+	if err := json.Unmarshal(data, recording); err != nil {
+		return nil, errors.New("invalid recording " + name + ": " + err.Error())
+	}
+	return recording, nil
+}
+
+// Replay runs the script of the recording called name again with the
+// recorded arguments, working directory, settings and standard input,
+// and the recorded environment variables over the current ones.
+func Replay(name string) error {
+	recording, err := ReadRecording(name)
+	if err != nil {
+		return err
+	}
+	if recording.Stdin {
+		dir, err := RecordingPath(name)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, "stdin"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := dupStdin(f); err != nil {
+			return err
+		}
+	}
+	if err := os.Chdir(recording.Dir); err != nil {
+		return err
+	}
+	for _, kv := range recording.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+	opts := recording.Options
+	if opts == nil {
+		opts = &Options{ExecAttempts: 1}
+	}
+	opts.Record = ""
+	opts.replayed = recording.SHA256
+	return Run(opts, append([]string{recording.Script}, recording.Args...))
+}
+
+// checkReplayed warns if runFile isn't the binary that ran when the run
+// being replayed was recorded.
+func checkReplayed(runFile, sum string) {
+	actual := ""
+	if meta, err := ReadMeta(runFile); err == nil {
+		actual = meta["sha256"]
+	}
+	if actual == "" {
+		actual, _ = FileHash(runFile)
+	}
+	if actual != sum {
+		fmt.Fprintln(os.Stderr, "gorun: the binary differs from the recorded one, the script or the way it's built changed since")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IsRemote reports whether sourcefile is the URL of a script, such as
+// https://example.com/script.go#sha256=...
+func IsRemote(sourcefile string) bool {
+	return strings.HasPrefix(sourcefile, "https://") || strings.HasPrefix(sourcefile, "http://")
+}
+
+var validSHA256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// RunRemote downloads the script at the URL args[0], which IsRemote, and
+// runs it with arguments args[1:].  The URL pins the script with a
+// #sha256= fragment, which it must match; unpinned scripts are only run
+// with --insecure.  Pinned scripts are downloaded once and kept in the
+// cache, unpinned ones on each run.
+func RunRemote(opts *Options, args []string) error {
+	u, err := url.Parse(args[0])
+	if err != nil {
+		return err
+	}
+	pin := ""
+	if u.Fragment != "" {
+		if !strings.HasPrefix(u.Fragment, "sha256=") {
+			return errors.New("unknown fragment in " + args[0] + ", expected #sha256=<checksum>")
+		}
+		pin = strings.ToLower(strings.TrimPrefix(u.Fragment, "sha256="))
+		if !validSHA256.MatchString(pin) {
+			return errors.New("invalid SHA-256 checksum in " + args[0])
+		}
+	}
+	u.Fragment = ""
+	switch {
+	case pin != "":
+		// The checksum stands for the manifest.
+		verified := *opts
+		verified.VerifyManifest = false
+		opts = &verified
+	case opts.VerifyManifest:
+		return errors.New("refusing to run " + u.String() + ": unpinned scripts can't be verified against a manifest")
+	case !opts.Insecure:
+		return errors.New("refusing to run " + u.String() + " without a checksum: add #sha256=<checksum> to the URL, or use --insecure")
+	}
+
+	// Keep the name of the script, which it may rely on.
+	name := path.Base(u.Path)
+	if !strings.HasSuffix(name, ".go") {
+		name = "script.go"
+	}
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	if pin != "" {
+		sourcefile := filepath.Join(auxDir(runBaseDir, "remote"), pin[:16], name)
+		if sum, err := FileHash(sourcefile); err == nil && sum == pin {
+			return Run(opts, append([]string{sourcefile}, args[1:]...))
+		}
+	}
+
+	content, err := fetch(u.String())
+	if err != nil {
+		return err
+	}
+	if len(content) == 0 {
+		return &exitError{ExitNotFound, errors.New("not found: " + u.String())}
+	}
+	sum := sha256.Sum256(content)
+	if pin != "" && hex.EncodeToString(sum[:]) != pin {
+		return errors.New("refusing to run " + u.String() + ": its SHA-256 checksum is " + hex.EncodeToString(sum[:]) + ", not " + pin)
+	}
+	dir := filepath.Join(auxDir(runBaseDir, "remote"), hex.EncodeToString(sum[:8]))
+	sourcefile, err := materialize(dir, name, content)
+	if err != nil {
+		return err
+	}
+	return Run(opts, append([]string{sourcefile}, args[1:]...))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// replSession accumulates the code entered in a REPL session.
+type replSession struct {
+	sections []byte   // go.mod, go.sum and go.env sections to build with
+	imports  []string // import paths, possibly with a name
+	decls    []string // top level declarations
+	stmts    []string // statements of main, in order
+	output   string   // what the accumulated statements print
+}
+
+// Repl runs an interactive Go session reading from in.  Each input is
+// compiled into a program along with everything entered before it, and
+// run: the statements entered before are run again, side effects
+// included, only their output being hidden.  Expressions have their
+// value printed.  The go.mod, go.sum and go.env sections of modfile, if
+// given, are used to build the program so that imports resolve as they
+// do for that script.
+func Repl(opts *Options, modfile string, in io.Reader) error {
+	session := &replSession{}
+	if modfile != "" {
+		content, err := ioutil.ReadFile(modfile)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"go.mod", "go.sum", "go.env"} {
+			if section := gorun.Section(content, name); len(section) > 0 {
+				session.sections = append(session.sections, embedSection(name, section)...)
+			}
+		}
+	}
+
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	runCmdDir := filepath.Join(runBaseDir, "repl-"+strconv.Itoa(os.Getpid())) + string(filepath.Separator)
+	if err := os.MkdirAll(runCmdDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(runCmdDir)
+
+	fmt.Println("gorun repl: enter Go declarations, statements or expressions; :help for help")
+	scanner := bufio.NewScanner(in)
+	var input []string
+	prompt := ">>> "
+	for {
+		fmt.Print(prompt)
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		input = append(input, scanner.Text())
+		code := strings.TrimSpace(strings.Join(input, "\n"))
+		if !balanced(code) {
+			prompt = "... "
+			continue
+		}
+		input, prompt = nil, ">>> "
+		switch code {
+		case "":
+			continue
+		case ":quit", ":q":
+			return nil
+		case ":help":
+			fmt.Println(":source  show the program built so far")
+			fmt.Println(":reset   forget everything entered so far")
+			fmt.Println(":quit    leave the session")
+			fmt.Println("Each input runs the statements entered before it again, side effects")
+			fmt.Println("included: keep those writing files or calling services for the end.")
+			continue
+		case ":source":
+			fmt.Print(string(session.program("")))
+			continue
+		case ":reset":
+			*session = replSession{sections: session.sections}
+			continue
+		}
+		if err := session.eval(opts, runCmdDir, code); err != nil {
+			fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		}
+	}
+}
+
+// eval adds code to the session and runs the resulting program,
+// printing what the new code printed.  Code that fails to compile is
+// dropped from the session.
+func (session *replSession) eval(opts *Options, runCmdDir, code string) error {
+	next := *session
+	switch {
+	case strings.HasPrefix(code, "import "):
+		spec := strings.TrimSpace(strings.TrimPrefix(code, "import "))
+		next.imports = append(append([]string(nil), session.imports...), spec)
+	case strings.HasPrefix(code, "func "), strings.HasPrefix(code, "type "), strings.HasPrefix(code, "const "):
+		next.decls = append(append([]string(nil), session.decls...), code)
+	case isExpr(code):
+		// Print the value, unless it's a call of a function without a
+		// single result, which can only be a statement.
+		if err := session.run(opts, runCmdDir, code, ioutil.Discard); err != errNotCompiled {
+			return err
+		}
+		fallthrough
+	default:
+		next.stmts = append(append([]string(nil), session.stmts...), code)
+	}
+	if err := next.run(opts, runCmdDir, "", os.Stderr); err != nil {
+		return err
+	}
+	*session = next
+	return nil
+}
+
+var errNotCompiled = errors.New("code doesn't compile")
+
+// run builds and runs the session's program, printing the value of expr
+// if it's not empty, and prints what the program printed beyond the
+// output of the previous statements.  Compilation problems are reported
+// to diagnostics.
+func (session *replSession) run(opts *Options, runCmdDir, expr string, diagnostics io.Writer) error {
+	sourcefile := filepath.Join(runCmdDir, "repl.go")
+	runFile := filepath.Join(runCmdDir, "repl")
+	if err := ioutil.WriteFile(sourcefile, session.program(expr), 0600); err != nil {
+		return err
+	}
+	build, err := opts.BuildSettings(sourcefile, nil)
+	if err != nil {
+		return err
+	}
+	build.Diagnostics = diagnostics
+	if err := Compile(sourcefile, runFile, runCmdDir, build); err != nil {
+		return errNotCompiled
+	}
+	out, err := exec.Command(runFile).CombinedOutput()
+	fmt.Print(strings.TrimPrefix(string(out), session.output))
+	if expr == "" {
+		session.output = string(out)
+	}
+	return err
+}
+
+// program returns the source of the session's program, printing the
+// value of expr at the end of main if it's not empty.
+func (session *replSession) program(expr string) []byte {
+	var buf bytes.Buffer
+	buf.Write(session.sections)
+	buf.WriteString("package main\n\nimport (\n\t\"fmt\"\n")
+	body := strings.Join(append(append(append([]string(nil), session.decls...), session.stmts...), expr), "\n")
+	for _, spec := range session.imports {
+		// Unused imports don't compile, so leave them out until used.
+		if spec != `"fmt"` && strings.Contains(body, importName(spec)+".") {
+			buf.WriteString("\t" + spec + "\n")
+		}
+	}
+	buf.WriteString(")\n\nvar _ = fmt.Sprint\n\n")
+	for _, decl := range session.decls {
+		buf.WriteString(decl + "\n\n")
+	}
+	buf.WriteString("func main() {\n")
+	for _, stmt := range session.stmts {
+		buf.WriteString(stmt + "\n")
+		// Unused variables don't compile either.
+		for _, name := range definedNames(stmt) {
+			buf.WriteString("_ = " + name + "\n")
+		}
+	}
+	if expr != "" {
+		buf.WriteString("fmt.Printf(\"%#v\\n\", " + expr + ")\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// embedSection returns section as an embedded section called name.
+func embedSection(name string, section []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("// " + name + " >>>\n")
+	for _, line := range strings.Split(strings.Trim(string(section), "\n"), "\n") {
+		buf.WriteString("// " + line + "\n")
+	}
+	buf.WriteString("// <<< " + name + "\n")
+	return buf.Bytes()
+}
+
+// importName returns the name a package is referred to by in code,
+// given an import spec such as `"net/http"` or `str "strings"`.
+func importName(spec string) string {
+	fields := strings.Fields(spec)
+	if len(fields) == 2 {
+		return fields[0]
+	}
+	path, _ := strconv.Unquote(spec)
+	name := path[strings.LastIndex(path, "/")+1:]
+	if strings.HasPrefix(name, "v") && leadingInt(name[1:]) > 0 && strings.Contains(path, "/") {
+		// A major version suffix such as /v2 isn't the package name.
+		path = path[:strings.LastIndex(path, "/")]
+		name = path[strings.LastIndex(path, "/")+1:]
+	}
+	return name
+}
+
+// isExpr reports whether code is an expression.
+func isExpr(code string) bool {
+	_, err := parser.ParseExpr(code)
+	return err == nil
+}
+
+// definedNames returns the variables defined by the statements in code.
+func definedNames(code string) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p; func f() {\n"+code+"\n}", 0)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	add := func(ident *ast.Ident) {
+		if ident.Name != "_" {
+			names = append(names, ident.Name)
+		}
+	}
+	for _, stmt := range f.Decls[0].(*ast.FuncDecl).Body.List {
+		switch stmt := stmt.(type) {
+		case *ast.AssignStmt:
+			if stmt.Tok == token.DEFINE {
+				for _, lhs := range stmt.Lhs {
+					if ident, ok := lhs.(*ast.Ident); ok {
+						add(ident)
+					}
+				}
+			}
+		case *ast.DeclStmt:
+			if decl, ok := stmt.Decl.(*ast.GenDecl); ok && decl.Tok == token.VAR {
+				for _, spec := range decl.Specs {
+					for _, ident := range spec.(*ast.ValueSpec).Names {
+						add(ident)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// balanced reports whether the brackets in code are all closed, so
+// that the input is complete.
+func balanced(code string) bool {
+	depth := 0
+	var s scannerState
+	for _, r := range code {
+		if s.skip(r) {
+			continue
+		}
+		switch r {
+		case '{', '(', '[':
+			depth++
+		case '}', ')', ']':
+			depth--
+		}
+	}
+	return depth <= 0 && s.quote == 0
+}
+
+// scannerState tracks whether balanced is inside a string literal.
+type scannerState struct {
+	quote   rune
+	escaped bool
+}
+
+func (s *scannerState) skip(r rune) bool {
+	switch {
+	case s.escaped:
+		s.escaped = false
+	case s.quote != 0 && r == '\\' && s.quote != '`':
+		s.escaped = true
+	case s.quote != 0 && r == s.quote:
+		s.quote = 0
+	case s.quote != 0:
+	case r == '"' || r == '\'' || r == '`':
+		s.quote = r
+	default:
+		return false
+	}
+	return true
+}
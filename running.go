@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RunRecord describes a script launched by gorun.
+type RunRecord struct {
+	Pid    int       `json:"pid"`
+	Script string    `json:"script"`
+	Args   []string  `json:"args"`
+	Binary string    `json:"binary"`
+	SHA256 string    `json:"sha256"`
+	Start  time.Time `json:"start"`
+	// ProcessStart is when the process started, as processStartTime
+	// tells, for a later process given the same pid not to be taken for
+	// it.
+	ProcessStart string `json:"process_start,omitempty"`
+	// Dir, Env and Options are what the script was launched with, so
+	// that it can be restarted the same way.  Like in recordings, the
+	// variables likely holding secrets are left out of Env.
+	Dir     string   `json:"dir"`
+	Env     []string `json:"env"`
+	Options *Options `json:"options"`
+}
+
+// RunningDir returns the directory the scripts launched by gorun are
+// tracked in, one file per process.  Like the metrics, it's kept above
+// runBaseDir so that it's shared by all architectures and never subject
+// to the cache cleaning.
+func RunningDir(runBaseDir string) string {
+	return filepath.Join(filepath.Dir(runBaseDir), "running")
+}
+
+// trackRun records that the process pid runs runFile, the binary of the
+// script args[0], with arguments args[1:] and settings opts.  Failing to
+// do so doesn't keep the script from running, so it's only reported.
+func trackRun(pid int, runFile string, args []string, opts *Options) {
+	if err := writeRunRecord(pid, runFile, args, opts); err != nil {
+		fmt.Fprintln(os.Stderr, "gorun: can't track the script: "+err.Error())
+	}
+}
+
+func writeRunRecord(pid int, runFile string, args []string, opts *Options) error {
+	runBaseDir, err := RunBaseDir()
+	if err != nil {
+		return err
+	}
+	script, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	record := &RunRecord{Pid: pid, Script: script, Args: args[1:], Binary: runFile, Start: time.Now(),
+		Dir: cwd, Env: publicEnv(os.Environ()), Options: opts}
+	if meta, err := ReadMeta(runFile); err == nil {
+		record.SHA256 = meta["sha256"]
+	}
+	record.ProcessStart, _ = processStartTime(pid)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	dir := RunningDir(runBaseDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file := filepath.Join(dir, strconv.Itoa(pid))
+	tmp := file + "." + strconv.Itoa(os.Getpid()) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// untrackRun forgets the process pid, which is done running its script.
+func untrackRun(pid int) {
+	if runBaseDir, err := RunBaseDir(); err == nil {
+		os.Remove(filepath.Join(RunningDir(runBaseDir), strconv.Itoa(pid)))
+	}
+}
+
+// RunningScripts returns the scripts launched by gorun that are still
+// running, oldest first.  The records of the processes that are gone
+// are removed.
+func RunningScripts(runBaseDir string) ([]*RunRecord, error) {
+	dir := RunningDir(runBaseDir)
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*RunRecord
+	for _, info := range infos {
+		pid, err := strconv.Atoi(info.Name())
+		if err != nil {
+			continue
+		}
+		file := filepath.Join(dir, info.Name())
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		record := &RunRecord{}
+		if json.Unmarshal(data, record) != nil || !processAlive(pid) || record.reused() {
+			os.Remove(file)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Start.Before(records[j].Start)
+	})
+	return records, nil
+}
+
+// RunningInstances returns the running instances of the script
+// sourcefile.
+func RunningInstances(runBaseDir, sourcefile string) ([]*RunRecord, error) {
+	script, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return nil, err
+	}
+	records, err := RunningScripts(runBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	var instances []*RunRecord
+	for _, record := range records {
+		if record.Script == script {
+			instances = append(instances, record)
+		}
+	}
+	return instances, nil
+}
+
+// reused reports whether the pid of record was given to another process
+// since the script was launched.
+func (record *RunRecord) reused() bool {
+	start, err := processStartTime(record.Pid)
+	return err == nil && record.ProcessStart != "" && start != record.ProcessStart
+}
+
+// verified reports whether the process of record still runs the script,
+// rather than being gone or another process given the same pid, so that
+// it can be signalled.
+func (record *RunRecord) verified() bool {
+	if record.ProcessStart == "" {
+		return false
+	}
+	start, err := processStartTime(record.Pid)
+	return err == nil && start == record.ProcessStart
+}
+
+// StopInstances sends SIGTERM to the processes of records, and SIGKILL
+// to those still running after grace.  The pidfiles of the daemons among
+// them are removed.  Processes that can't be told to still run their
+// script, their pid having been reused or their start time not being
+// known, are refused.
+func StopInstances(records []*RunRecord, grace time.Duration) error {
+	var running []*RunRecord
+	for _, record := range records {
+		if record.verified() {
+			running = append(running, record)
+		} else if processAlive(record.Pid) {
+			return errors.New("refusing to stop " + strconv.Itoa(record.Pid) + ": can't tell it still runs " + record.Script)
+		} else {
+			untrackRun(record.Pid)
+		}
+	}
+	records = running
+	for _, record := range records {
+		if err := stopProcess(record.Pid); err != nil {
+			return errors.New("can't stop " + strconv.Itoa(record.Pid) + ": " + err.Error())
+		}
+	}
+	deadline := time.Now().Add(grace)
+	for _, record := range records {
+		for processAlive(record.Pid) && record.verified() {
+			if time.Now().After(deadline) {
+				killProcess(record.Pid)
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		untrackRun(record.Pid)
+		if record.Options != nil && record.Options.PidFile != "" {
+			pidFile := record.Options.PidFile
+			if !filepath.IsAbs(pidFile) {
+				pidFile = filepath.Join(record.Dir, pidFile)
+			}
+			if readPidFile(pidFile) == record.Pid {
+				os.Remove(pidFile)
+			}
+		}
+	}
+	return nil
+}
+
+// Restart runs the script of record again, rebuilt if its source
+// changed, with the arguments, directory, environment and settings it
+// was launched with.  The secrets left out of the record are taken from
+// the current environment instead.  Like Run, it only returns once the
+// script is done, unless gorun is replaced with it.
+func (record *RunRecord) Restart() error {
+	if err := os.Chdir(record.Dir); err != nil {
+		return err
+	}
+	for _, kv := range publicEnv(os.Environ()) {
+		os.Unsetenv(kv[:strings.Index(kv, "=")])
+	}
+	for _, kv := range record.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+	opts := record.Options
+	if opts == nil {
+		opts = &Options{ExecAttempts: 1}
+	}
+	return Run(opts, append([]string{record.Script}, record.Args...))
+}
+
+// PrintRunning writes records to w, as a table or as JSON.
+func PrintRunning(w io.Writer, records []*RunRecord, asJSON bool) error {
+	if asJSON {
+		if records == nil {
+			records = []*RunRecord{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PID\tSTARTED\tBINARY\tSCRIPT")
+	for _, record := range records {
+		sum := record.SHA256
+		if len(sum) > 12 {
+			sum = sum[:12]
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", record.Pid, record.Start.Format("2006-01-02 15:04:05"), sum,
+			strings.TrimSpace(record.Script+" "+strings.Join(record.Args, " ")))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRunRecordProcess(t *testing.T) {
+	start, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Skip(err)
+	}
+	if again, _ := processStartTime(os.Getpid()); again != start {
+		t.Fatalf("start time changed from %q to %q", start, again)
+	}
+	tests := []struct {
+		processStart     string
+		reused, verified bool
+	}{
+		{start, false, true},
+		{start + "0", true, false},
+		// Recorded without a start time: can't be told apart.
+		{"", false, false},
+	}
+	for _, test := range tests {
+		record := &RunRecord{Pid: os.Getpid(), ProcessStart: test.processStart}
+		if record.reused() != test.reused || record.verified() != test.verified {
+			t.Errorf("start %q: got reused %v and verified %v", test.processStart, record.reused(), record.verified())
+		}
+	}
+	if err := StopInstances([]*RunRecord{{Pid: os.Getpid(), Script: "s.go"}}, 0); err == nil {
+		t.Error("stopping a process that can't be verified")
+	}
+}
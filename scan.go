@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// scriptScan is what gorun needs to know about a script to run it,
+// gathered while streaming through it so that huge generated scripts
+// are never held in memory.
+type scriptScan struct {
+	bom     bool // the script starts with a UTF-8 byte order mark
+	shebang bool // the script starts with a bang line
+
+	// headerLines is the number of lines of the shell preamble of a
+	// polyglot script, ended by a //gorun:header-end line, if any.
+	headerLines int
+
+	// header holds the lines of the script gorun looks at: pragmas,
+	// embedded sections and the lines telling whether its binary can
+	// be shared, in order.  It can be used in place of the whole
+	// script by Pragmas, getSection and ObjectFile.
+	header []byte
+}
+
+// scanLineMax is the length beyond which lines are skipped by
+// scanScript, as they can't be part of the header.
+const scanLineMax = 64 << 10
+
+// scanScript reads sourcefile once, in constant memory besides its
+// header.
+func scanScript(sourcefile string) (*scriptScan, error) {
+	f, err := os.Open(sourcefile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, scanLineMax)
+	scan := &scriptScan{}
+	var header bytes.Buffer
+	section := ""
+	inPackage := false
+	lineNo := 0
+	for first := true; ; first = false {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Too long to matter: skip the rest of it.
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			line = nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if first {
+			if bytes.HasPrefix(line, utf8BOM) {
+				scan.bom = true
+				line = line[len(utf8BOM):]
+			}
+			scan.shebang = bytes.HasPrefix(line, []byte("#!"))
+		}
+		lineNo++
+		trimmed := bytes.TrimSpace(line)
+		if !inPackage && section == "" && string(trimmed) == gorun.HeaderEnd {
+			// What came before was shell, not Go.
+			scan.headerLines = lineNo
+			header.Reset()
+		} else if !inPackage && section == "" && bytes.HasPrefix(trimmed, []byte("package ")) {
+			inPackage = true
+		}
+		switch {
+		case lineNo <= scan.headerLines:
+		case section != "":
+			header.Write(line)
+			if string(trimmed) == "// <<< "+section {
+				section = ""
+			}
+		case bytes.HasPrefix(trimmed, []byte(pragmaPrefix)),
+			bytes.Contains(line, []byte("//go:embed")),
+			bytes.Contains(line, []byte(`import "C"`)):
+			header.Write(line)
+		default:
+			if name, ok := sectionStart(string(trimmed)); ok {
+				section = name
+				header.Write(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	scan.header = header.Bytes()
+	return scan, nil
+}
+
+// writeRewritten copies sourcefile to dst without its byte order mark,
+// if it has one, with its bang line turned into a comment, if it has
+// one, and its polyglot header blanked, streaming it to keep memory use
+// flat.  A line directive is
+// added at the top so that compilation errors and stack traces refer to
+// sourcefile rather than to the copy.
+func writeRewritten(sourcefile, dst string, scan *scriptScan) error {
+	path, err := filepath.Abs(sourcefile)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(sourcefile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if scan.bom {
+		if _, err := in.Seek(int64(len(utf8BOM)), io.SeekStart); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write([]byte("//line " + path + ":1:1\n"))
+	var rest io.Reader = in
+	if err == nil && scan.headerLines > 0 {
+		// Blank lines keep the line numbers.
+		r := bufio.NewReader(in)
+		for i := 0; i < scan.headerLines && err == nil; i++ {
+			if _, err = r.ReadString('\n'); err == nil {
+				_, err = out.Write([]byte("\n"))
+			}
+		}
+		rest = r
+	} else if err == nil && scan.shebang {
+		if _, err = in.Seek(2, io.SeekCurrent); err == nil {
+			_, err = out.Write([]byte("//"))
+		}
+	}
+	if err == nil {
+		_, err = io.Copy(out, rest)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeSource writes the source built for sourcefile to dst: source, the
+// output of its preprocessors or template, if it isn't nil, or else the
+// script itself rewritten.
+func writeSource(sourcefile, dst string, scan *scriptScan, source []byte) error {
+	if source != nil {
+		return writePreprocessed(sourcefile, dst, source)
+	}
+	return writeRewritten(sourcefile, dst, scan)
+}
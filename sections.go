@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// SectionBuild is what the handlers of the embedded sections of a
+// script contribute to its build.
+type SectionBuild struct {
+	// Dir is the directory the contributed files are written to.
+	Dir string
+	// Files holds the names of the files written to Dir, which the
+	// build sees next to the script.  The Go files among them are
+	// compiled along with it.
+	Files []string
+	// Env holds environment variables for go build.
+	Env []string
+}
+
+// SectionHandler contributes a section of the script sourcefile to its
+// build.
+type SectionHandler func(sourcefile string, section []byte, build *SectionBuild) error
+
+// sectionHandlers maps the names of the sections gorun knows to their
+// handlers.  A nil handler marks a section that's used by gorun in
+// other ways than contributing to the build.
+var sectionHandlers = map[string]SectionHandler{
+	"go.mod":     nil,
+	"go.sum":     nil,
+	"go.flags":   nil,
+	"usage":      nil,
+	"completion": nil,
+	"cron":       nil,
+	"go.env": func(sourcefile string, section []byte, build *SectionBuild) error {
+		build.Env = append(build.Env, ExpandGoEnv(section)...)
+		return nil
+	},
+}
+
+// SectionFlags returns the go build flags in a go.flags section, one per
+// line, as in -ldflags=-s -w, lines starting with # being comments.
+func SectionFlags(section []byte) ([]string, error) {
+	var flags []string
+	for _, line := range strings.Split(string(section), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimLeft(line, "-"), "=", 2)[0]
+		if !strings.HasPrefix(line, "-") || name == "" {
+			return nil, errors.New("not a flag in the go.flags section: " + line)
+		}
+		if name == "o" || name == "overlay" {
+			return nil, errors.New("-" + name + " is set by gorun, not in the go.flags section")
+		}
+		flags = append(flags, line)
+	}
+	return flags, nil
+}
+
+// RegisterSection makes handler contribute the sections called name to
+// the builds of scripts.
+func RegisterSection(name string, handler SectionHandler) {
+	if _, ok := sectionHandlers[name]; ok {
+		panic("section registered twice: " + name)
+	}
+	sectionHandlers[name] = handler
+}
+
+// sectionPluginPrefix starts the names of the commands handling the
+// sections gorun doesn't know.
+const sectionPluginPrefix = "gorun-section-"
+
+// SectionContributions runs the handlers of the sections in content,
+// the header of sourcefile, in order, writing the files they contribute
+// to dir.  Sections gorun doesn't know are handled by the command named
+// gorun-section-<name> in PATH, if there's one, and are otherwise left
+// alone.
+func SectionContributions(sourcefile string, content []byte, dir string) (*SectionBuild, error) {
+	build := &SectionBuild{Dir: dir}
+	for _, name := range sectionNames(content) {
+		handler, ok := sectionHandlers[name]
+		if !ok {
+			if plugin, err := exec.LookPath(sectionPluginPrefix + name); err == nil {
+				handler = pluginHandler(plugin)
+			}
+		}
+		if handler == nil {
+			continue
+		}
+		if err := handler(sourcefile, gorun.Section(content, name), build); err != nil {
+			return nil, errors.New("section " + name + ": " + err.Error())
+		}
+	}
+	return build, nil
+}
+
+// pluginHandler returns the handler running the command plugin in the
+// directory of the script, with the section on stdin and a new empty
+// directory as argument.  The files the command writes to the directory
+// are contributed to the build, and the NAME=value lines it prints set
+// environment variables for go build.
+func pluginHandler(plugin string) SectionHandler {
+	return func(sourcefile string, section []byte, build *SectionBuild) error {
+		out, err := ioutil.TempDir(build.Dir, "section")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(out)
+		var stdout bytes.Buffer
+		cmd := exec.Command(plugin, out)
+		cmd.Dir = filepath.Dir(sourcefile)
+		cmd.Stdin = bytes.NewReader(section)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.New(filepath.Base(plugin) + " failed: " + err.Error())
+		}
+		scanner := bufio.NewScanner(&stdout)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if i := strings.Index(line, "="); i > 0 {
+				build.Env = append(build.Env, line)
+			} else if line != "" {
+				return errors.New(filepath.Base(plugin) + " printed " + line + ", not NAME=value")
+			}
+		}
+		files, err := ioutil.ReadDir(out)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() {
+				return errors.New(filepath.Base(plugin) + " wrote " + file.Name() + ", not a regular file")
+			}
+			if err := build.AddFile(file.Name(), filepath.Join(out, file.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// AddFile contributes the file at path to the build as name, moving it
+// to build.Dir.
+func (build *SectionBuild) AddFile(name, path string) error {
+	if name == "go.mod" || name == "go.sum" {
+		return errors.New("can't contribute " + name + ", use a " + name + " section")
+	}
+	for _, file := range build.Files {
+		if file == name {
+			return errors.New(name + " contributed twice")
+		}
+	}
+	if err := os.Rename(path, filepath.Join(build.Dir, name)); err != nil {
+		return err
+	}
+	build.Files = append(build.Files, name)
+	return nil
+}
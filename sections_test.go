@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSectionFlags(t *testing.T) {
+	tests := []struct {
+		section string
+		flags   []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"\n-tags=netgo\n", []string{"-tags=netgo"}, true},
+		{"-ldflags=-s -w\n  -trimpath  \n", []string{"-ldflags=-s -w", "-trimpath"}, true},
+		{"# comment\n-race\n\n#-msan\n", []string{"-race"}, true},
+		{"--tags=a,b\n", []string{"--tags=a,b"}, true},
+		{"tags=netgo\n", nil, false},
+		{"-\n", nil, false},
+		{"-=x\n", nil, false},
+		{"-o=out\n", nil, false},
+		{"--overlay=o.json\n", nil, false},
+	}
+	for _, test := range tests {
+		flags, err := SectionFlags([]byte(test.section))
+		if (err == nil) != test.ok || strings.Join(flags, "\n") != strings.Join(test.flags, "\n") {
+			t.Errorf("SectionFlags(%q) = %q, %v", test.section, flags, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var validCapabilities = regexp.MustCompile(`^[a-z_,]+[=+-][eip]*$`)
+
+// capabilities returns the Linux file capabilities requested by the
+// //gorun:setcap pragmas in pragmas, in the text form setcap takes, as
+// in cap_net_raw,cap_net_bind_service+ep, or "" if there's none.
+func capabilities(pragmas []Pragma) (string, error) {
+	var caps []string
+	for _, pragma := range pragmas {
+		if pragma.Name != "setcap" {
+			continue
+		}
+		if len(pragma.Args) == 0 {
+			return "", errors.New("usage: //gorun:setcap <capabilities>")
+		}
+		for _, arg := range pragma.Args {
+			if !validCapabilities.MatchString(arg) {
+				return "", errors.New("invalid capabilities: " + arg)
+			}
+		}
+		caps = append(caps, pragma.Args...)
+	}
+	if len(caps) > 0 && runtime.GOOS != "linux" {
+		return "", errors.New("file capabilities are only supported on Linux")
+	}
+	return strings.Join(caps, " "), nil
+}
+
+// ApplyCapabilities grants caps to the binary runFile, which takes root.
+// The helper command in GORUN_SETCAP_HELPER is run with caps and
+// runFile as arguments if it's set, or else setcap through sudo, which
+// may prompt for a password.
+func ApplyCapabilities(runFile, caps string) error {
+	var cmd *exec.Cmd
+	if helper := os.Getenv("GORUN_SETCAP_HELPER"); helper != "" {
+		cmd = exec.Command(helper, caps, runFile)
+	} else if os.Geteuid() == 0 {
+		cmd = exec.Command("setcap", caps, runFile)
+	} else {
+		cmd = exec.Command("sudo", "setcap", caps, runFile)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("can't grant " + caps + " to " + runFile + ": " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// sudoCommand returns the path and arguments running runFile as root,
+// with arguments args[1:], through sudo or the command in GORUN_SUDO,
+// such as doas or pkexec, which prompts for the user's password.
+func sudoCommand(runFile string, args []string) (string, []string, error) {
+	sudo := os.Getenv("GORUN_SUDO")
+	if sudo == "" {
+		sudo = "sudo"
+	}
+	path, err := exec.LookPath(sudo)
+	if err != nil {
+		return "", nil, errors.New("can't run " + args[0] + " as root: " + err.Error())
+	}
+	fmt.Fprintln(os.Stderr, "gorun: running "+args[0]+" as root with "+filepath.Base(path))
+	argv := []string{sudo}
+	if filepath.Base(path) != "pkexec" {
+		// pkexec rejects --, and takes no options after the program anyway.
+		argv = append(argv, "--")
+	}
+	return path, append(append(argv, runFile), args[1:]...), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SumsFileName is the name of the file listing the expected checksums of
+// the scripts of a directory, checked with --verify-manifest.
+const SumsFileName = "gorun.sum"
+
+// readSums reads the checksums listed in path, in the format of
+// sha256sum, keyed by file name.
+func readSums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) != 64 {
+			return nil, errors.New(path + ":" + strconv.Itoa(line) + ": expected <sha256>  <file name>")
+		}
+		// sha256sum marks files read in binary mode with a star.
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+// VerifySums checks that sourcefile and the files it includes match the
+// checksums listed for them in the gorun.sum file of their directory.
+func VerifySums(sourcefile string, includes []string) error {
+	cache := make(map[string]map[string]string)
+	for _, path := range append([]string{sourcefile}, includes...) {
+		dir, name := filepath.Split(path)
+		sumsFile := filepath.Join(dir, SumsFileName)
+		sums, ok := cache[sumsFile]
+		if !ok {
+			var err error
+			if sums, err = readSums(sumsFile); os.IsNotExist(err) {
+				return errors.New("refusing to run " + sourcefile + ": no " + sumsFile + " to verify it against")
+			} else if err != nil {
+				return err
+			}
+			cache[sumsFile] = sums
+		}
+		expected, ok := sums[name]
+		if !ok {
+			return errors.New("refusing to run " + sourcefile + ": " + path + " isn't listed in " + sumsFile)
+		}
+		sum, err := FileHash(path)
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			return errors.New("refusing to run " + sourcefile + ": " + path + " doesn't match its checksum in " + sumsFile)
+		}
+	}
+	return nil
+}
+
+// VerifyContent checks that content, read from sourcefile, matches the
+// checksum listed for sourcefile in the gorun.sum file of its directory.
+// It's for scripts run from a copy, or read from a pipe, where checking
+// the file again wouldn't tell what was read.
+func VerifyContent(sourcefile string, content []byte) error {
+	dir, name := filepath.Split(sourcefile)
+	sumsFile := filepath.Join(dir, SumsFileName)
+	sums, err := readSums(sumsFile)
+	if os.IsNotExist(err) {
+		return errors.New("refusing to run " + sourcefile + ": no " + sumsFile + " to verify it against")
+	} else if err != nil {
+		return err
+	}
+	expected, ok := sums[name]
+	if !ok {
+		return errors.New("refusing to run " + sourcefile + ": it isn't listed in " + sumsFile)
+	}
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != expected {
+		return errors.New("refusing to run " + sourcefile + ": it doesn't match its checksum in " + sumsFile)
+	}
+	return nil
+}
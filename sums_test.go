@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSums(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		content string
+		sums    map[string]string
+		ok      bool
+	}{
+		{"", map[string]string{}, true},
+		{sum + "  a.go\n", map[string]string{"a.go": sum}, true},
+		{"# comment\n\n" + strings.ToUpper(sum) + " *b.go\r\n", map[string]string{"b.go": sum}, true},
+		{sum + "  a.go\n" + sum[:62] + "cd  a.go\n", map[string]string{"a.go": sum[:62] + "cd"}, true},
+		{sum + "\n", nil, false},
+		{sum + "  a b.go\n", nil, false},
+		{sum[:63] + "  a.go\n", nil, false},
+	}
+	dir, err := ioutil.TempDir("", "gorun-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, SumsFileName)
+	for _, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		sums, err := readSums(path)
+		if (err == nil) != test.ok || test.ok && !reflect.DeepEqual(sums, test.sums) {
+			t.Errorf("readSums(%q) = %v, %v", test.content, sums, err)
+		}
+	}
+}
+
+func TestVerifySums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gorun-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "s.go")
+	content := []byte("package main\n")
+	if err := ioutil.WriteFile(script, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if VerifySums(script, nil) == nil || VerifyContent(script, content) == nil {
+		t.Error("verified without a gorun.sum")
+	}
+	sum := sha256.Sum256(content)
+	if err := ioutil.WriteFile(filepath.Join(dir, SumsFileName), []byte(hex.EncodeToString(sum[:])+"  s.go\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySums(script, nil); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyContent(script, content); err != nil {
+		t.Error(err)
+	}
+	if VerifyContent(script, []byte("package other\n")) == nil {
+		t.Error("verified other contents")
+	}
+	if VerifySums(script, []string{filepath.Join(dir, "unlisted.go")}) == nil {
+		t.Error("verified an unlisted include")
+	}
+	if err := ioutil.WriteFile(script, []byte("package main // changed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if VerifySums(script, nil) == nil {
+		t.Error("verified a changed script")
+	}
+}
@@ -1,5 +1,5 @@
-//go:build !darwin && !freebsd && !netbsd
-// +build !darwin,!freebsd,!netbsd
+//go:build !darwin && !freebsd && !netbsd && !windows
+// +build !darwin,!freebsd,!netbsd,!windows
 
 package main
 
@@ -9,3 +9,9 @@ import "syscall"
 func atime(info os.FileInfo) syscall.Timespec {
 	return sysStat(info).Atim
 }
+
+// maxRSS returns the maximum resident set size in ru, in bytes.
+// The kernel reports it in kilobytes.
+func maxRSS(ru *syscall.Rusage) int64 {
+	return int64(ru.Maxrss) * 1024
+}
@@ -9,3 +9,9 @@ import "syscall"
 func atime(info os.FileInfo) syscall.Timespec {
 	return sysStat(info).Atimespec
 }
+
+// maxRSS returns the maximum resident set size in ru, in bytes.
+// The kernel reports it in kilobytes.
+func maxRSS(ru *syscall.Rusage) int64 {
+	return int64(ru.Maxrss) * 1024
+}
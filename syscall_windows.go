@@ -0,0 +1,14 @@
+package main
+
+import "os"
+import "syscall"
+
+func atime(info os.FileInfo) syscall.Timespec {
+	return syscall.NsecToTimespec(info.Sys().(*syscall.Win32FileAttributeData).LastAccessTime.Nanoseconds())
+}
+
+// maxRSS returns the maximum resident set size in ru, in bytes.
+// Windows doesn't report it along with the process times.
+func maxRSS(ru *syscall.Rusage) int64 {
+	return 0
+}
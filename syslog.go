@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"log/syslog"
+)
+
+type syslogLogger struct {
+	w *syslog.Writer
+}
+
+func newSyslogLogger(ident string) (Logger, error) {
+	w, err := syslog.New(syslog.LOG_USER|syslog.LOG_INFO, ident)
+	if err != nil {
+		return nil, errors.New("can't connect to syslog: " + err.Error())
+	}
+	return syslogLogger{w}, nil
+}
+
+func (l syslogLogger) Log(priority int, line string) error {
+	switch priority {
+	case PriorityErr:
+		return l.w.Err(line)
+	case PriorityNotice:
+		return l.w.Notice(line)
+	}
+	return l.w.Info(line)
+}
+
+func (l syslogLogger) Close() error {
+	return l.w.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Target is a platform scripts are built for.
+type Target struct {
+	GOOS   string
+	GOARCH string
+}
+
+func (t Target) String() string {
+	return t.GOOS + "/" + t.GOARCH
+}
+
+// exeSuffix returns the suffix of the executables of t.
+func (t Target) exeSuffix() string {
+	if t.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+var validTarget = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9]+$`)
+
+// ParseTargets parses a comma-separated list of GOOS/GOARCH targets, as
+// in linux/amd64,darwin/arm64.
+func ParseTargets(list string) ([]Target, error) {
+	var targets []Target
+	for _, target := range strings.Split(list, ",") {
+		target = strings.TrimSpace(target)
+		if !validTarget.MatchString(target) {
+			return nil, errors.New("invalid target, expected GOOS/GOARCH: " + target)
+		}
+		i := strings.Index(target, "/")
+		targets = append(targets, Target{target[:i], target[i+1:]})
+	}
+	return targets, nil
+}
+
+// compileTarget compiles sourcefile with build for target into the
+// binary bin, using dir as sandbox.
+func compileTarget(sourcefile, bin, dir string, build *BuildSettings, target Target) error {
+	targetBuild := *build
+	targetBuild.Env = append(append([]string(nil), build.Env...), "GOOS="+target.GOOS, "GOARCH="+target.GOARCH)
+	return Compile(sourcefile, bin, dir+string(filepath.Separator), &targetBuild)
+}
+
+// VerifyTargets builds sourcefile with the settings in opts for each of
+// targets, without running it, and reports on w which ones fail along
+// with their compilation errors.
+func VerifyTargets(opts *Options, sourcefile string, targets []Target, w io.Writer) error {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return err
+	}
+	if err := opts.PrepareSource(sourcefile, content, build); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "gorun-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	failed := 0
+	for i, target := range targets {
+		var diagnostics bytes.Buffer
+		build.Diagnostics = &diagnostics
+		dir := filepath.Join(tmp, strconv.Itoa(i))
+		if err := compileTarget(sourcefile, filepath.Join(dir, "bin"), dir, build, target); err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL\t%s\n", target)
+			w.Write(diagnostics.Bytes())
+			continue
+		}
+		fmt.Fprintf(w, "ok\t%s\n", target)
+	}
+	if failed > 0 {
+		return &exitError{ExitCompile, errors.New(strconv.Itoa(failed) + " of " + strconv.Itoa(len(targets)) + " targets failed")}
+	}
+	return nil
+}
+
+// Release builds sourcefile with the settings in opts for each of
+// targets into dist, naming the binaries after the script and the
+// target, as in mytool_linux_amd64, gzipping them if compress is set,
+// and writes their checksums to dist/SHA256SUMS in the format of
+// sha256sum.  It returns the paths of the files written.
+func Release(opts *Options, sourcefile string, targets []Target, dist string, compress bool) ([]string, error) {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return nil, &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.PrepareSource(sourcefile, content, build); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dist, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir("", "gorun-release-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	name := strings.TrimSuffix(filepath.Base(sourcefile), ".go")
+	var written []string
+	var sums bytes.Buffer
+	for i, target := range targets {
+		dir := filepath.Join(tmp, strconv.Itoa(i))
+		bin := filepath.Join(dir, "bin")
+		if err := compileTarget(sourcefile, bin, dir, build, target); err != nil {
+			return written, &exitError{ExitCompile, errors.New(target.String() + ": " + err.Error())}
+		}
+		artifact := name + "_" + target.GOOS + "_" + target.GOARCH
+		if target.GOOS == "windows" {
+			artifact += ".exe"
+		}
+		path := filepath.Join(dist, artifact)
+		if compress {
+			path += ".gz"
+			err = gzipFile(bin, path, artifact)
+		} else {
+			err = copyFile(bin, path, 0755)
+		}
+		if err != nil {
+			return written, err
+		}
+		written = append(written, path)
+		sum, err := FileHash(path)
+		if err != nil {
+			return written, err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", sum, filepath.Base(path))
+	}
+	sumsFile := filepath.Join(dist, "SHA256SUMS")
+	if err := ioutil.WriteFile(sumsFile, sums.Bytes(), 0644); err != nil {
+		return written, err
+	}
+	return append(written, sumsFile), nil
+}
+
+// gzipFile writes the file src gzipped to dst, recording name as the
+// name of the original file.
+func gzipFile(src, dst, name string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	gz.Name = name
+	_, err = io.Copy(gz, in)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
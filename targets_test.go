@@ -0,0 +1,56 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuildSettingsTarget(t *testing.T) {
+	other := "windows"
+	if runtime.GOOS == other {
+		other = "linux"
+	}
+	tests := []struct {
+		goos, goarch string
+		target       Target
+	}{
+		{"", "", Target{}},
+		{runtime.GOOS, runtime.GOARCH, Target{}},
+		{other, "", Target{other, runtime.GOARCH}},
+		{other, "arm64", Target{other, "arm64"}},
+	}
+	for _, test := range tests {
+		opts := &Options{GOOS: test.goos, GOARCH: test.goarch}
+		build, err := opts.BuildSettings("s.go", []byte("package main\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if build.Target != test.target {
+			t.Errorf("--goos=%q --goarch=%q: got target %v, want %v", test.goos, test.goarch, build.Target, test.target)
+		}
+		env := strings.Join(build.Env, " ")
+		if cross := test.target != (Target{}); cross != strings.Contains(env, "GOOS=") {
+			t.Errorf("--goos=%q --goarch=%q: got environment %q", test.goos, test.goarch, env)
+		}
+	}
+	if _, err := (&Options{GOOS: "Win/dows"}).BuildSettings("s.go", []byte("package main\n")); err == nil {
+		t.Error("invalid GOOS accepted")
+	}
+}
+
+func TestDefaultOutput(t *testing.T) {
+	tests := []struct {
+		sourcefile, goos, output string
+	}{
+		{"dir/tool.go", "linux", "tool"},
+		{"dir/tool.go", "windows", "tool.exe"},
+		{"dir/tool", "linux", "tool.bin"},
+		{"dir/tool", "windows", "tool.exe"},
+	}
+	for _, test := range tests {
+		if output := defaultOutput(test.sourcefile, test.goos); output != test.output {
+			t.Errorf("defaultOutput(%q, %q) = %q, want %q", test.sourcefile, test.goos, output, test.output)
+		}
+	}
+}
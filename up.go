@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Process is a script run by gorun up.
+type Process struct {
+	// Name prefixes the output lines of the script.
+	Name string
+	// Args holds the script and its arguments.
+	Args []string
+}
+
+// ProcfileName is the file gorun up reads the scripts to run from when
+// none are given.
+const ProcfileName = "Procfile"
+
+// ReadProcfile reads the processes listed in the Procfile at path, one
+// per line as in
+//
+//	api: api.go --port=8080
+//	worker: tools/worker.go
+//
+// Scripts are relative to the directory holding the Procfile, and lines
+// starting with # are comments.
+func ReadProcfile(path string) ([]Process, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var processes []Process
+	names := map[string]bool{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		fields := strings.Fields(line[i+1:])
+		if i <= 0 || len(fields) == 0 {
+			return nil, errors.New(path + ":" + strconv.Itoa(n+1) + ": expected name: script [arguments]")
+		}
+		name := strings.TrimSpace(line[:i])
+		if names[name] {
+			return nil, errors.New(path + ":" + strconv.Itoa(n+1) + ": duplicate process " + name)
+		}
+		names[name] = true
+		if !filepath.IsAbs(fields[0]) {
+			fields[0] = filepath.Join(filepath.Dir(path), fields[0])
+		}
+		processes = append(processes, Process{Name: name, Args: fields})
+	}
+	if len(processes) == 0 {
+		return nil, errors.New(path + ": no processes")
+	}
+	return processes, nil
+}
+
+// ScriptProcesses returns the processes running the scripts given,
+// named after their files.
+func ScriptProcesses(scripts []string) []Process {
+	var processes []Process
+	seen := map[string]int{}
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".go")
+		seen[name]++
+		if seen[name] > 1 {
+			name += "." + strconv.Itoa(seen[name])
+		}
+		processes = append(processes, Process{Name: name, Args: []string{script}})
+	}
+	return processes
+}
+
+// upColors are the ANSI colors given in turn to the processes.
+var upColors = []string{"36", "33", "32", "35", "34", "31"}
+
+// prefixWriter writes the lines of a process to w, prefixed with its
+// name.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+}
+
+func (p *prefixWriter) line(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(p.w, p.prefix+text)
+}
+
+// copyLines writes the lines read from r with the prefix of p.
+func (p *prefixWriter) copyLines(wg *sync.WaitGroup, r io.Reader) {
+	defer wg.Done()
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			p.line(strings.TrimSuffix(line, "\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Up runs the processes concurrently through gorun, with the gorun
+// flags given, until one of them exits or gorun is interrupted; the
+// others are then sent SIGTERM, and SIGKILL if they're still running
+// after grace.  Their output is written to w, each line prefixed with
+// the name of the process, in color if color is set.  It returns the
+// exit status of the first process that exited, or 128 plus the number
+// of the signal that interrupted gorun.
+func Up(processes []Process, gorunFlags []string, grace time.Duration, w io.Writer, color bool) (int, error) {
+	gorun, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	width := len("gorun")
+	for _, p := range processes {
+		if len(p.Name) > width {
+			width = len(p.Name)
+		}
+	}
+	var mu sync.Mutex
+	prefix := func(name string, i int) *prefixWriter {
+		label := name + strings.Repeat(" ", width-len(name)) + " | "
+		if color {
+			label = "\x1b[" + upColors[i%len(upColors)] + "m" + label + "\x1b[0m"
+		}
+		return &prefixWriter{mu: &mu, w: w, prefix: label}
+	}
+	system := prefix("gorun", len(processes))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	type exit struct {
+		name   string
+		status int
+	}
+	exits := make(chan exit, len(processes))
+	var cmds []*exec.Cmd
+	for i, p := range processes {
+		cmd := exec.Command(gorun, append(append([]string{}, gorunFlags...), p.Args...)...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return 0, err
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return 0, err
+		}
+		if err := cmd.Start(); err != nil {
+			for _, started := range cmds {
+				started.Process.Kill()
+			}
+			return 0, errors.New("can't start " + p.Name + ": " + err.Error())
+		}
+		cmds = append(cmds, cmd)
+		out := prefix(p.Name, i)
+		go func(name string, cmd *exec.Cmd) {
+			var output sync.WaitGroup
+			output.Add(2)
+			go out.copyLines(&output, stdout)
+			go out.copyLines(&output, stderr)
+			output.Wait()
+			cmd.Wait()
+			exits <- exit{name, processStatus(cmd.ProcessState)}
+		}(p.Name, cmd)
+	}
+
+	var status int
+	remaining := len(processes)
+	select {
+	case e := <-exits:
+		system.line(e.name + " exited with status " + strconv.Itoa(e.status))
+		status = e.status
+		remaining--
+	case sig := <-signals:
+		system.line("interrupted by " + signalName(sig.(syscall.Signal)))
+		status = 128 + int(sig.(syscall.Signal))
+	}
+	if remaining == 0 {
+		return status, nil
+	}
+	system.line("sending SIGTERM to all processes")
+	for _, cmd := range cmds {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	kill := time.After(grace)
+	for ; remaining > 0; remaining-- {
+		select {
+		case e := <-exits:
+			system.line(e.name + " exited with status " + strconv.Itoa(e.status))
+			continue
+		case <-kill:
+		case <-signals:
+			// Interrupted again, so don't wait any longer.
+		}
+		system.line("sending SIGKILL to all processes")
+		for _, cmd := range cmds {
+			cmd.Process.Kill()
+		}
+		kill = nil
+		e := <-exits
+		system.line(e.name + " exited with status " + strconv.Itoa(e.status))
+	}
+	return status, nil
+}
+
+// processStatus returns the exit status of a process, 128+N if it was
+// killed by signal N.
+func processStatus(state *os.ProcessState) int {
+	ws := state.Sys().(syscall.WaitStatus)
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
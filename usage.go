@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// helpArgs are the arguments commonly asking a program for help.
+var helpArgs = map[string]bool{"-h": true, "-help": true, "--help": true}
+
+// ScriptUsage returns the text of the usage section of a script, or
+// nil if it has none.
+func ScriptUsage(content []byte) []byte {
+	section := bytes.Trim(gorun.Section(content, "usage"), "\n")
+	if len(section) == 0 {
+		return nil
+	}
+	return append(section, '\n')
+}
+
+// PrintScriptUsage writes the usage section of sourcefile to w.
+func PrintScriptUsage(w io.Writer, sourcefile string) error {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	text := ScriptUsage(content)
+	if text == nil {
+		return errors.New(sourcefile + " has no usage section")
+	}
+	_, err = w.Write(text)
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsRevision returns the commit gorun was built from, as recorded by go
+// build, and whether the work tree had local modifications.
+func vcsRevision(info *debug.BuildInfo) (revision string, modified bool) {
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	return revision, modified
+}
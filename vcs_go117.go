@@ -0,0 +1,12 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsRevision returns the commit gorun was built from, which go build
+// only records since Go 1.18.
+func vcsRevision(info *debug.BuildInfo) (revision string, modified bool) {
+	return "", false
+}
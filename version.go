@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// version is the version of gorun, set at link time with
+// -ldflags "-X main.version=v1.2.3" by release builds.  Otherwise the
+// version of the main module is used, if it was built from a module.
+var version = ""
+
+// PrintVersion writes the version of gorun and the commit it was built
+// from, the Go toolchain it was built with, and the go tool compiling
+// scripts to w.
+func PrintVersion(w io.Writer) error {
+	v, commit := version, ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		if revision, modified := vcsRevision(info); revision != "" {
+			commit = revision
+			if modified {
+				commit += " (modified)"
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	fmt.Fprintln(w, "gorun "+v)
+	if commit != "" {
+		fmt.Fprintln(w, "commit: "+commit)
+	}
+	fmt.Fprintln(w, "built with: "+runtime.Version()+" "+runtime.GOOS+"/"+runtime.GOARCH)
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return err
+	}
+	goVersion, err := GoVersion(gotool)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, "go tool: "+gotool+" (go"+goVersion+")")
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// Warm downloads the modules required by the embedded go.mod section of
+// sourcefile into the module cache, without building the script, so
+// that later builds don't need the network.  The output of the go tool
+// is written to out.
+func Warm(opts *Options, sourcefile string, out *bytes.Buffer) error {
+	content, err := ioutil.ReadFile(sourcefile)
+	if os.IsNotExist(err) {
+		return &exitError{ExitNotFound, err}
+	}
+	if err != nil {
+		return err
+	}
+	content = bytes.TrimPrefix(content, utf8BOM)
+	build, err := opts.BuildSettings(sourcefile, content)
+	if err != nil {
+		return err
+	}
+	if len(gorun.Section(content, "go.mod")) == 0 && len(build.GoMod) == 0 {
+		// Only the standard library can be used.
+		return nil
+	}
+	_, runFile, _, err := RunFilePaths(sourcefile, build)
+	if err != nil {
+		return err
+	}
+
+	// Keep away from the go.mod and go.sum of builds running meanwhile.
+	dir := runFile + ".warm." + strconv.Itoa(os.Getpid())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if _, _, err := writeModule(content, build, dir); err != nil {
+		return err
+	}
+
+	var env []string
+	section := gorun.Section(content, "go.env")
+	if len(section) > 0 || len(build.Env) > 0 {
+		env = os.Environ()
+		env = append(env, ExpandGoEnv(section)...)
+		env = append(env, build.Env...)
+	}
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return err
+	}
+	if len(build.Requires) > 0 {
+		return resolveRequires(gotool, dir, env, build.Requires, out)
+	}
+	return ExecTo(dir, env, []string{gotool, "mod", "download"}, out, out)
+}
+
+// WarmAll warms the given scripts, at most jobs at a time, and returns
+// the output and outcome of each in order.
+func WarmAll(opts *Options, sourcefiles []string, jobs int) ([]bytes.Buffer, []error) {
+	outs := make([]bytes.Buffer, len(sourcefiles))
+	errs := make([]error, len(sourcefiles))
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, sourcefile := range sourcefiles {
+		wg.Add(1)
+		go func(i int, sourcefile string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = Warm(opts, sourcefile, &outs[i])
+		}(i, sourcefile)
+	}
+	wg.Wait()
+	return outs, errs
+}
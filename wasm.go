@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+// wasmShell is the page running the script in the browser.  It reloads
+// itself when the script changes.
+var wasmShell = template.Must(template.New("shell").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+<script src="wasm_exec.js"></script>
+<script>
+(async () => {
+	const resp = await fetch("main.wasm");
+	if (!resp.ok) {
+		document.getElementById("errors").textContent = await resp.text();
+	} else {
+		const go = new Go();
+		const result = await WebAssembly.instantiate(await resp.arrayBuffer(), go.importObject);
+		go.run(result.instance);
+	}
+	const version = await (await fetch("version")).text();
+	setInterval(async () => {
+		if (await (await fetch("version")).text() !== version) {
+			location.reload();
+		}
+	}, 1000);
+})();
+</script>
+</head>
+<body>
+<pre id="errors" style="color: #c00"></pre>
+</body>
+</html>
+`))
+
+// wasmExec returns the path of the wasm_exec.js support file of the Go
+// installation of gotool.
+func wasmExec(gotool string) (string, error) {
+	var out bytes.Buffer
+	if err := ExecTo("", nil, []string{gotool, "env", "GOROOT"}, &out, os.Stderr); err != nil {
+		return "", err
+	}
+	goroot := strings.TrimSpace(out.String())
+	for _, dir := range []string{"lib", "misc"} {
+		path := filepath.Join(goroot, dir, "wasm", "wasm_exec.js")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("can't find wasm_exec.js in " + goroot)
+}
+
+// ServeWasm builds sourcefile with the settings in opts for
+// GOOS=js GOARCH=wasm and serves it on addr along with a page running
+// it, rebuilding it when it changed since it was last served.
+func ServeWasm(opts *Options, sourcefile, addr string) error {
+	gotool, err := gorun.GoTool()
+	if err != nil {
+		return err
+	}
+	support, err := wasmExec(gotool)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "gorun-wasm-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	// Serving only ends when interrupted.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		os.RemoveAll(tmp)
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+	bin := filepath.Join(tmp, "main.wasm")
+
+	var mu sync.Mutex
+	var built time.Time
+	var buildErrors []byte
+	// build rebuilds the script if it changed, and returns the version
+	// of the script served.
+	build := func() (time.Time, []byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		content, err := ioutil.ReadFile(sourcefile)
+		if err != nil {
+			return built, nil, err
+		}
+		settings, err := opts.BuildSettings(sourcefile, content)
+		if err != nil {
+			return built, nil, err
+		}
+		modTime, err := newestModTime(sourcefile, settings.Includes)
+		if err != nil {
+			return built, nil, err
+		}
+		if !modTime.After(built) {
+			return built, buildErrors, nil
+		}
+		if err := opts.PrepareSource(sourcefile, content, settings); err != nil {
+			return built, nil, err
+		}
+		var diagnostics bytes.Buffer
+		settings.Diagnostics = &diagnostics
+		built, buildErrors = modTime, nil
+		if err := compileTarget(sourcefile, bin, filepath.Join(tmp, "build"), settings, Target{"js", "wasm"}); err != nil {
+			buildErrors = append(diagnostics.Bytes(), err.Error()+"\n"...)
+			os.Stderr.Write(buildErrors)
+		}
+		return built, buildErrors, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		wasmShell.Execute(w, filepath.Base(sourcefile))
+	})
+	mux.HandleFunc("/wasm_exec.js", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, support)
+	})
+	mux.HandleFunc("/main.wasm", func(w http.ResponseWriter, r *http.Request) {
+		_, failed, err := build()
+		if err != nil || failed != nil {
+			if err != nil {
+				failed = []byte(err.Error())
+			}
+			http.Error(w, string(failed), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/wasm")
+		w.Header().Set("Cache-Control", "no-store")
+		http.ServeFile(w, r, bin)
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		version, _, err := build()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, strconv.FormatInt(version.UnixNano(), 10))
+	})
+
+	if _, _, err := build(); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "gorun: serving "+sourcefile+" on http://"+displayAddr(addr))
+	return http.ListenAndServe(addr, mux)
+}
+
+// displayAddr returns the address to browse to for the listening
+// address addr.
+func displayAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/erning/gorun/pkg/gorun"
+)
+
+const (
+	// watchInterval is how often watched files are checked for changes.
+	watchInterval = 500 * time.Millisecond
+	// watchGrace is how long the script is given to stop before being
+	// killed on a change.
+	watchGrace = 5 * time.Second
+)
+
+// Watch runs the script args[0] with arguments args[1:] as gorun would
+// with the gorun flags in flags, then restarts it whenever it or the
+// files its build depends on change, until gorun is interrupted.  The
+// script runs under a gorun child process, so it's rebuilt the usual
+// way; compilation errors are shown and the next change awaited.
+func Watch(flags []string, args []string) error {
+	script := args
+	if len(script) > 0 && script[0] == "run" {
+		script = script[1:]
+	} else if _, ok := lookupCommand(script[0]); ok {
+		return errors.New("--watch only runs scripts, not gorun " + script[0])
+	}
+	if len(script) == 0 {
+		return usageError("run")
+	}
+	sourcefile := resolveScript(script[0])
+	if sourcefile == "-" || IsRemote(sourcefile) || IsPiped(sourcefile) {
+		return errors.New("can't watch " + sourcefile + ": not a local file")
+	}
+	if stat, err := os.Stat(sourcefile); err != nil {
+		return &exitError{ExitNotFound, err}
+	} else if stat.IsDir() {
+		return errors.New("can't watch " + sourcefile + ": not a file")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// The last --watch wins, including over the default flags.
+	argv := append(append(append([]string(nil), flags...), "--watch=false"), args...)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for {
+		files := watchedFiles(sourcefile)
+		before := snapshot(files)
+		cmd := exec.Command(exe, argv...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		done := make(chan int, 1)
+		go func() {
+			cmd.Wait()
+			done <- cmd.ProcessState.ExitCode()
+		}()
+
+		running := true
+		for changed := ""; changed == ""; {
+			select {
+			case sig := <-signals:
+				// Like shells do when interrupted.
+				status := 128 + int(sig.(syscall.Signal))
+				if running {
+					cmd.Process.Signal(sig)
+					if code := <-done; code >= 0 {
+						status = code
+					}
+				}
+				return &exitError{status, nil}
+			case status := <-done:
+				running = false
+				outcome := "exited with status " + strconv.Itoa(status)
+				if status < 0 {
+					outcome = "was killed"
+				}
+				fmt.Fprintln(os.Stderr, "gorun: "+script[0]+" "+outcome+", waiting for changes")
+			case <-time.After(watchInterval):
+				changed = before.changed(snapshot(files))
+			}
+			if changed != "" {
+				// Let editors finish writing.
+				for last := snapshot(files); ; {
+					time.Sleep(watchInterval)
+					now := snapshot(files)
+					if now.changed(last) == "" {
+						break
+					}
+					last = now
+				}
+				fmt.Fprintln(os.Stderr, "gorun: "+changed+" changed, restarting "+script[0])
+			}
+		}
+		if running {
+			stopWatched(cmd, done)
+		}
+	}
+}
+
+// stopWatched stops the script cmd runs, killing it if it doesn't exit
+// within watchGrace, and waits for it to be done.
+func stopWatched(cmd *exec.Cmd, done <-chan int) {
+	stopProcess(cmd.Process.Pid)
+	select {
+	case <-done:
+	case <-time.After(watchGrace):
+		killProcess(cmd.Process.Pid)
+		<-done
+	}
+}
+
+// watchedFiles returns the files the build of sourcefile depends on: the
+// script, the files it includes, a go.mod it references with the
+// //gorun:gomod pragma, and the directories its go.mod replaces modules
+// with.
+func watchedFiles(sourcefile string) []string {
+	files := []string{sourcefile}
+	content, err := ioutil.ReadFile(sourcefile)
+	if err != nil {
+		return files
+	}
+	pragmas := Pragmas(content)
+	// Broken includes are left to the build to report.
+	if included, err := includedFiles(sourcefile, pragmas); err == nil {
+		files = append(files, included...)
+	}
+	mod, modDir := gorun.Section(content, "go.mod"), filepath.Dir(sourcefile)
+	if ref := pragmaValue(pragmas, "gomod"); len(mod) == 0 && ref != "" && !IsRemote(ref) {
+		if !filepath.IsAbs(ref) {
+			ref = filepath.Join(modDir, ref)
+		}
+		files = append(files, ref)
+		mod, _ = ioutil.ReadFile(ref)
+		modDir = filepath.Dir(ref)
+	}
+	for _, dir := range localReplacements(mod) {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(modDir, dir)
+		}
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// localReplacements returns the directories the replace directives of
+// the go.mod mod replace modules with.
+func localReplacements(mod []byte) []string {
+	var dirs []string
+	scanner := bufio.NewScanner(bytes.NewReader(mod))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, "=>")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i+2:])
+		if len(fields) == 0 {
+			continue
+		}
+		dir := fields[0]
+		if strings.HasPrefix(dir, "./") || strings.HasPrefix(dir, "../") || filepath.IsAbs(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// fileSnapshot holds the modification times and sizes of files, missing
+// files being absent.
+type fileSnapshot map[string]os.FileInfo
+
+func snapshot(files []string) fileSnapshot {
+	s := fileSnapshot{}
+	for _, file := range files {
+		if stat, err := os.Stat(file); err == nil {
+			s[file] = stat
+		}
+	}
+	return s
+}
+
+// changed returns one of the files that changed between s and now, or
+// "" if none did.
+func (s fileSnapshot) changed(now fileSnapshot) string {
+	for file, stat := range now {
+		old, ok := s[file]
+		if !ok || !old.ModTime().Equal(stat.ModTime()) || old.Size() != stat.Size() {
+			return file
+		}
+	}
+	for file := range s {
+		if _, ok := now[file]; !ok {
+			return file
+		}
+	}
+	return ""
+}